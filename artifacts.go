@@ -0,0 +1,297 @@
+package lunash
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// ArtifactStoreEnv is the environment variable for the artifact store's
+// location.
+const ArtifactStoreEnv = "LUNASH_STORE"
+
+// Artifact is a version of a file fetched from an HSM.
+type Artifact struct {
+	Host    string    `json:"host"`
+	Path    string    `json:"path"`
+	Fetched time.Time `json:"fetched"`
+	Digest  string    `json:"digest"`
+	Size    int64     `json:"size"`
+}
+
+// ArtifactStore is a local, content-addressed history of files fetched from
+// HSMs. Contents are stored once per digest under objects/ and every fetch is
+// recorded in index.jsonl.
+type ArtifactStore struct {
+	dir string
+}
+
+// DefaultArtifactStoreDir returns $LUNASH_STORE, or ~/.local/share/lunash/store.
+func DefaultArtifactStoreDir() string {
+	if dir := os.Getenv(ArtifactStoreEnv); dir != "" {
+		return dir
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+
+	return filepath.Join(home, ".local", "share", "lunash", "store")
+}
+
+// OpenArtifactStore opens the artifact store in dir, creating it if needed.
+// If dir is empty, DefaultArtifactStoreDir is used.
+func OpenArtifactStore(dir string) (*ArtifactStore, error) {
+	if dir == "" {
+		dir = DefaultArtifactStoreDir()
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0700); err != nil {
+		return nil, errors.Wrap(err, "Error creating artifact store")
+	}
+
+	return &ArtifactStore{dir: dir}, nil
+}
+
+// Add stores the contents of r as a new version of the file at path on host.
+// changed is set if the contents differ from the previous version, or if
+// there's no previous version.
+func (s *ArtifactStore) Add(host, path string, r io.Reader) (artifact *Artifact, changed bool, err error) {
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, "objects"), ".tmp")
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Error writing artifact")
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Error writing artifact")
+	}
+
+	artifact = &Artifact{
+		Host:    host,
+		Path:    path,
+		Fetched: time.Now().UTC(),
+		Digest:  "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Size:    size,
+	}
+
+	object := s.objectPath(artifact.Digest)
+	if _, err = os.Stat(object); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(object), 0700); err == nil {
+			err = os.Rename(tmp.Name(), object)
+		}
+		if err != nil {
+			return nil, false, errors.Wrap(err, "Error writing artifact")
+		}
+	}
+
+	versions, err := s.Versions(host, path)
+	if err != nil {
+		return nil, false, err
+	}
+	changed = len(versions) == 0 || versions[len(versions)-1].Digest != artifact.Digest
+
+	if err = s.record(artifact); err != nil {
+		return nil, false, err
+	}
+
+	return artifact, changed, nil
+}
+
+// Fetch gets the file at path from the HSM and stores it as a new version,
+// recorded under the HSM's name. changed is set as for Add.
+func (s *ArtifactStore) Fetch(client *Client, path string) (*Artifact, bool, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		_, err := client.ScpGetTo(path, pw)
+		pw.CloseWithError(err)
+	}()
+
+	artifact, changed, err := s.Add(client.config.Name(), path, pr)
+	pr.Close()
+
+	return artifact, changed, err
+}
+
+// record appends an artifact to the index.
+func (s *ArtifactStore) record(artifact *Artifact) error {
+	line, err := json.Marshal(artifact)
+	if err != nil {
+		return errors.Wrap(err, "Error encoding artifact")
+	}
+
+	index, err := os.OpenFile(s.indexPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Error opening artifact index")
+	}
+
+	if _, err = index.Write(append(line, '\n')); err != nil {
+		index.Close()
+		return errors.Wrap(err, "Error writing artifact index")
+	}
+
+	return errors.Wrap(index.Close(), "Error writing artifact index")
+}
+
+// Versions returns the versions of the file at path on host, oldest first. An
+// empty host or path matches every host or path.
+func (s *ArtifactStore) Versions(host, path string) ([]Artifact, error) {
+	index, err := os.Open(s.indexPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Error opening artifact index")
+	}
+	defer index.Close()
+
+	var versions []Artifact
+
+	scanner := bufio.NewScanner(index)
+	for n := 1; scanner.Scan(); n++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var artifact Artifact
+		if err = json.Unmarshal(scanner.Bytes(), &artifact); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Error reading artifact index line %d", n))
+		}
+
+		if !validDigest(artifact.Digest) {
+			return nil, fmt.Errorf("Bad digest '%s' on artifact index line %d", artifact.Digest, n)
+		}
+
+		if (host == "" || artifact.Host == host) && (path == "" || artifact.Path == path) {
+			versions = append(versions, artifact)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Error reading artifact index")
+	}
+
+	return versions, nil
+}
+
+// Changes returns the versions whose contents differ from the previous version
+// of the same file on the same host, including first versions, oldest first.
+// An empty host or path matches every host or path.
+func (s *ArtifactStore) Changes(host, path string) ([]Artifact, error) {
+	versions, err := s.Versions(host, path)
+	if err != nil {
+		return nil, err
+	}
+
+	last := make(map[[2]string]string)
+	var changes []Artifact
+
+	for _, artifact := range versions {
+		key := [2]string{artifact.Host, artifact.Path}
+		if last[key] != artifact.Digest {
+			changes = append(changes, artifact)
+		}
+		last[key] = artifact.Digest
+	}
+
+	return changes, nil
+}
+
+// Find returns the artifact whose digest starts with the given prefix, which
+// may omit the "sha256:" prefix.
+func (s *ArtifactStore) Find(prefix string) (*Artifact, error) {
+	if !strings.HasPrefix(prefix, "sha256:") {
+		prefix = "sha256:" + prefix
+	}
+
+	versions, err := s.Versions("", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var found *Artifact
+	for i := range versions {
+		if strings.HasPrefix(versions[i].Digest, prefix) {
+			if found != nil && found.Digest != versions[i].Digest {
+				return nil, fmt.Errorf("Digest %s is ambiguous", prefix)
+			}
+			found = &versions[i]
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("No artifact with digest %s", prefix)
+	}
+
+	return found, nil
+}
+
+// Read returns an artifact's contents.
+func (s *ArtifactStore) Read(artifact *Artifact) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.objectPath(artifact.Digest))
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading artifact")
+	}
+	return data, nil
+}
+
+// Diff returns a unified diff between the contents of two artifacts.
+func (s *ArtifactStore) Diff(a, b *Artifact) (string, error) {
+	adata, err := s.Read(a)
+	if err != nil {
+		return "", err
+	}
+
+	bdata, err := s.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(adata)),
+		B:        difflib.SplitLines(string(bdata)),
+		FromFile: a.label(),
+		ToFile:   b.label(),
+		Context:  3,
+	})
+}
+
+// label describes an artifact in diffs.
+func (a *Artifact) label() string {
+	return fmt.Sprintf("%s:%s@%s", a.Host, a.Path, a.Fetched.Format(time.RFC3339))
+}
+
+func (s *ArtifactStore) indexPath() string {
+	return filepath.Join(s.dir, "index.jsonl")
+}
+
+// validDigest returns whether digest is a "sha256:" prefixed, hex encoded
+// SHA-256 digest, as recorded by Add.
+func validDigest(digest string) bool {
+	sum, err := hex.DecodeString(strings.TrimPrefix(digest, "sha256:"))
+	return err == nil && len(sum) == sha256.Size && strings.HasPrefix(digest, "sha256:")
+}
+
+// objectPath is where the contents with the given digest are stored, split
+// into directories by the first two hex digits.
+func (s *ArtifactStore) objectPath(digest string) string {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	return filepath.Join(s.dir, "objects", hex[:2], hex[2:])
+}
@@ -0,0 +1,105 @@
+package lunash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lunash")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenArtifactStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	first, changed, err := store.Add("hsm1", "server.pem", strings.NewReader("cert one\n"))
+	if assert.Nil(t, err) {
+		assert.True(t, changed)
+		assert.Equal(t, int64(9), first.Size)
+		assert.True(t, strings.HasPrefix(first.Digest, "sha256:"))
+	}
+
+	_, changed, err = store.Add("hsm1", "server.pem", strings.NewReader("cert one\n"))
+	if assert.Nil(t, err) {
+		assert.False(t, changed)
+	}
+
+	_, changed, err = store.Add("hsm2", "server.pem", strings.NewReader("cert one\n"))
+	if assert.Nil(t, err) {
+		assert.True(t, changed)
+	}
+
+	second, changed, err := store.Add("hsm1", "server.pem", strings.NewReader("cert two\n"))
+	if assert.Nil(t, err) {
+		assert.True(t, changed)
+	}
+
+	versions, err := store.Versions("hsm1", "server.pem")
+	if assert.Nil(t, err) {
+		assert.Equal(t, 3, len(versions))
+	}
+
+	all, err := store.Versions("", "")
+	if assert.Nil(t, err) {
+		assert.Equal(t, 4, len(all))
+	}
+
+	changes, err := store.Changes("hsm1", "")
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(changes)) {
+		assert.Equal(t, first.Digest, changes[0].Digest)
+		assert.Equal(t, second.Digest, changes[1].Digest)
+	}
+
+	found, err := store.Find(strings.TrimPrefix(second.Digest, "sha256:")[:12])
+	if assert.Nil(t, err) {
+		assert.Equal(t, second.Digest, found.Digest)
+	}
+	_, err = store.Find("ffffffffffff")
+	assert.NotNil(t, err)
+
+	diff, err := store.Diff(first, second)
+	if assert.Nil(t, err) {
+		assert.Contains(t, diff, "-cert one\n")
+		assert.Contains(t, diff, "+cert two\n")
+	}
+}
+
+func TestArtifactStoreBadIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lunash")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenArtifactStore(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	if _, _, err = store.Add("hsm1", "server.pem", strings.NewReader("cert one\n")); !assert.Nil(t, err) {
+		return
+	}
+
+	index, err := os.OpenFile(filepath.Join(dir, "index.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = index.WriteString(`{"host":"hsm1","path":"server.pem","digest":"sha256:a"}` + "\n")
+	index.Close()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	_, err = store.Versions("hsm1", "server.pem")
+	assert.EqualError(t, err, "Bad digest 'sha256:a' on artifact index line 2")
+}
@@ -0,0 +1,172 @@
+package lunash
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"time"
+)
+
+// CertStatus is how close a certificate is to expiring. The values are the
+// exit codes monitoring systems like Nagios expect.
+type CertStatus int
+
+// Certificate statuses. They're ranked by Worse rather than by value.
+const (
+	CertOK       CertStatus = 0
+	CertWarning  CertStatus = 1
+	CertCritical CertStatus = 2
+	CertUnknown  CertStatus = 3
+)
+
+// statusRanks orders statuses from best to worst. A certificate known to be
+// expiring is worse than one that couldn't be checked.
+var statusRanks = map[CertStatus]int{
+	CertOK:       0,
+	CertWarning:  1,
+	CertUnknown:  2,
+	CertCritical: 3,
+}
+
+// Worse returns whether s is worse than other.
+func (s CertStatus) Worse(other CertStatus) bool {
+	return statusRanks[s] > statusRanks[other]
+}
+
+// String returns the status's name.
+func (s CertStatus) String() string {
+	switch s {
+	case CertOK:
+		return "OK"
+	case CertWarning:
+		return "WARNING"
+	case CertCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// CertInfo describes a certificate fetched from an HSM.
+type CertInfo struct {
+	// Path is the certificate's path in the HSM's file area.
+	Path string
+
+	Subject  string
+	Issuer   string
+	DNSNames []string
+	IPs      []string
+
+	// KeyType is "RSA", "ECDSA" or "Ed25519", and KeyBits is the key size.
+	KeyType string
+	KeyBits int
+
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// DaysLeft is the number of whole days until the certificate expires,
+	// negative if it already has.
+	DaysLeft int
+
+	Fingerprint string
+}
+
+// NewCertInfo describes a certificate as of the given time.
+func NewCertInfo(path string, cert *x509.Certificate, now time.Time) *CertInfo {
+	info := &CertInfo{
+		Path:        path,
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		DNSNames:    cert.DNSNames,
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		DaysLeft:    int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24)),
+		Fingerprint: CertFingerprint(cert),
+	}
+
+	for _, ip := range cert.IPAddresses {
+		info.IPs = append(info.IPs, ip.String())
+	}
+
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		info.KeyType, info.KeyBits = "RSA", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		info.KeyType, info.KeyBits = "ECDSA", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		info.KeyType, info.KeyBits = "Ed25519", 256
+	default:
+		info.KeyType = cert.PublicKeyAlgorithm.String()
+	}
+
+	return info
+}
+
+// Status returns the certificate's status given the number of days before
+// expiry that it becomes a warning or critical.
+func (i *CertInfo) Status(warnDays, critDays int) CertStatus {
+	switch {
+	case i.DaysLeft < critDays:
+		return CertCritical
+	case i.DaysLeft < warnDays:
+		return CertWarning
+	}
+	return CertOK
+}
+
+// InspectCerts fetches the NTLS certificate and the certificates listed in
+// the config from the HSM and describes them. Files holding a chain yield a
+// CertInfo per certificate.
+func (c *Client) InspectCerts(now time.Time) ([]*CertInfo, error) {
+	paths := append([]string{NTLSCertPath}, c.config.Certs...)
+
+	var infos []*CertInfo
+	for _, path := range paths {
+		data, err := c.ScpGet(path)
+		if err != nil {
+			return infos, err
+		}
+
+		certs, err := parseCertsPEM(data)
+		if err != nil {
+			return infos, fmt.Errorf("Error parsing certificate %s: %s", path, err)
+		}
+
+		for _, cert := range certs {
+			infos = append(infos, NewCertInfo(path, cert, now))
+		}
+	}
+
+	return infos, nil
+}
+
+// parseCertsPEM parses every PEM encoded certificate in data.
+func parseCertsPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+
+	return certs, nil
+}
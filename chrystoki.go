@@ -0,0 +1,171 @@
+package lunash
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultLunaCertDir is where the Luna client keeps certificates on Linux.
+const DefaultLunaCertDir = "/usr/safenet/lunaclient/cert"
+
+// ChrystokiServer is an HSM as a Luna client connects to it.
+type ChrystokiServer struct {
+	// Name is the HSM's name in the lunash config.
+	Name     string
+	Hostname string
+	Port     int
+
+	// CertPEM is the HSM's NTLS certificate, server.pem.
+	CertPEM []byte
+}
+
+// NewChrystokiServer returns the server for an HSM, given its NTLS
+// certificate.
+func NewChrystokiServer(config *Config, certPEM []byte) (*ChrystokiServer, error) {
+	if _, err := parseCertPEM(certPEM); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Bad NTLS certificate for %s", config.Name()))
+	}
+
+	return &ChrystokiServer{
+		Name:     config.Name(),
+		Hostname: config.Hostname,
+		Port:     NTLSPort,
+		CertPEM:  certPEM,
+	}, nil
+}
+
+// HAGroup is a high availability group of partitions on several HSMs, which
+// the Luna client presents as one virtual token.
+type HAGroup struct {
+	Label string
+
+	// Serial is the group's serial number. It defaults to "1" followed by
+	// the first member's serial, like "vtl haAdmin newGroup".
+	Serial string
+
+	// Members are the serial numbers of the member partitions.
+	Members []string
+}
+
+// ParseHAGroup parses an HA group given as "<label>=<serial>,<serial>...".
+func ParseHAGroup(spec string) (*HAGroup, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Bad HA group '%s'. Must be <label>=<partition serial>,...", spec)
+	}
+
+	group := &HAGroup{Label: strings.TrimSpace(parts[0])}
+	for _, member := range strings.Split(parts[1], ",") {
+		if member = strings.TrimSpace(member); member != "" {
+			group.Members = append(group.Members, member)
+		}
+	}
+
+	return group, group.check()
+}
+
+func (g *HAGroup) check() error {
+	if err := checkArg("HA group label", g.Label); err != nil {
+		return err
+	}
+	if len(g.Members) == 0 {
+		return fmt.Errorf("HA group '%s' has no members", g.Label)
+	}
+	for _, member := range append([]string{g.Serial}, g.Members...) {
+		if strings.Trim(member, "0123456789") != "" {
+			return fmt.Errorf("Bad serial number '%s' in HA group '%s'", member, g.Label)
+		}
+	}
+	return nil
+}
+
+// ChrystokiConfig is the part of a Luna client's Chrystoki.conf that says
+// which HSMs it connects to and how it trusts them.
+type ChrystokiConfig struct {
+	Servers  []*ChrystokiServer
+	HAGroups []*HAGroup
+
+	// Client is the client's hostname, which names its certificate and key
+	// files, as written by "vtl createCert" or GenerateClientCert.
+	Client string
+
+	// CertDir is the Luna client's certificate directory, holding
+	// client/<Client>.pem, client/<Client>Key.pem and server/CAFile.pem.
+	// It defaults to DefaultLunaCertDir.
+	CertDir string
+}
+
+var chrystokiTemplate = template.Must(template.New("Chrystoki.conf").Funcs(template.FuncMap{"join": strings.Join}).Parse(`LunaSA Client = {
+   ClientPrivKeyFile = {{.CertDir}}/client/{{.Client}}Key.pem;
+   ClientCertFile = {{.CertDir}}/client/{{.Client}}.pem;
+   ServerCAFile = {{.CertDir}}/server/CAFile.pem;
+{{- range $i, $s := .Servers}}
+   ServerName{{printf "%02d" $i}} = {{$s.Hostname}};
+   ServerPort{{printf "%02d" $i}} = {{$s.Port}};
+   ServerHtl{{printf "%02d" $i}} = 0;
+{{- end}}
+}
+{{- if .HAGroups}}
+VirtualToken = {
+{{- range $i, $g := .HAGroups}}
+   VirtualToken{{printf "%02d" $i}}Label = {{$g.Label}};
+   VirtualToken{{printf "%02d" $i}}SN = {{$g.Serial}};
+   VirtualToken{{printf "%02d" $i}}Members = {{join $g.Members ","}};
+{{- end}}
+}
+HASynchronize = {
+{{- range .HAGroups}}
+   {{.Label}} = 1;
+{{- end}}
+}
+{{- end}}
+`))
+
+// WriteConf writes the Chrystoki.conf entries for the servers and HA groups,
+// to be merged into the client's Chrystoki.conf.
+func (c *ChrystokiConfig) WriteConf(w io.Writer) error {
+	if err := checkArg("client host", c.Client); err != nil {
+		return err
+	}
+	if len(c.Servers) == 0 {
+		return fmt.Errorf("No servers to write")
+	}
+
+	conf := *c
+	if conf.CertDir == "" {
+		conf.CertDir = DefaultLunaCertDir
+	}
+	conf.CertDir = path.Clean(conf.CertDir)
+
+	conf.HAGroups = make([]*HAGroup, len(c.HAGroups))
+	for i, group := range c.HAGroups {
+		g := *group
+		if g.Serial == "" && len(g.Members) > 0 {
+			g.Serial = "1" + g.Members[0]
+		}
+		if err := g.check(); err != nil {
+			return err
+		}
+		conf.HAGroups[i] = &g
+	}
+
+	return errors.Wrap(chrystokiTemplate.Execute(w, &conf), "Error writing Chrystoki.conf")
+}
+
+// WriteServerBundle writes the servers' certificates as one PEM file, the
+// client's server/CAFile.pem. Each certificate is preceded by a comment
+// naming its HSM.
+func (c *ChrystokiConfig) WriteServerBundle(w io.Writer) error {
+	for _, server := range c.Servers {
+		certPEM := strings.TrimSpace(string(server.CertPEM))
+		if _, err := fmt.Fprintf(w, "# %s (%s)\n%s\n", server.Name, server.Hostname, certPEM); err != nil {
+			return errors.Wrap(err, "Error writing server bundle")
+		}
+	}
+	return nil
+}
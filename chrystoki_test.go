@@ -0,0 +1,110 @@
+package lunash
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChrystokiConfigWriteConf(t *testing.T) {
+	conf := &ChrystokiConfig{
+		Servers: []*ChrystokiServer{
+			{Name: "hsm1", Hostname: "hsm1.example.com", Port: NTLSPort},
+			{Name: "hsm2", Hostname: "10.0.0.2", Port: NTLSPort},
+		},
+		HAGroups: []*HAGroup{{Label: "app-ha", Members: []string{"532018011", "1280742000001"}}},
+		Client:   "app1.example.com",
+	}
+
+	var buf bytes.Buffer
+	if assert.Nil(t, conf.WriteConf(&buf)) {
+		assert.Equal(t, `LunaSA Client = {
+   ClientPrivKeyFile = /usr/safenet/lunaclient/cert/client/app1.example.comKey.pem;
+   ClientCertFile = /usr/safenet/lunaclient/cert/client/app1.example.com.pem;
+   ServerCAFile = /usr/safenet/lunaclient/cert/server/CAFile.pem;
+   ServerName00 = hsm1.example.com;
+   ServerPort00 = 1792;
+   ServerHtl00 = 0;
+   ServerName01 = 10.0.0.2;
+   ServerPort01 = 1792;
+   ServerHtl01 = 0;
+}
+VirtualToken = {
+   VirtualToken00Label = app-ha;
+   VirtualToken00SN = 1532018011;
+   VirtualToken00Members = 532018011,1280742000001;
+}
+HASynchronize = {
+   app-ha = 1;
+}
+`, buf.String())
+	}
+
+	// The caller's groups aren't changed.
+	assert.Equal(t, "", conf.HAGroups[0].Serial)
+
+	conf.HAGroups = nil
+	conf.CertDir = "/opt/luna/cert/"
+	buf.Reset()
+	if assert.Nil(t, conf.WriteConf(&buf)) {
+		assert.Contains(t, buf.String(), "ServerCAFile = /opt/luna/cert/server/CAFile.pem;")
+		assert.NotContains(t, buf.String(), "VirtualToken")
+	}
+
+	assert.EqualError(t, (&ChrystokiConfig{Client: "app1"}).WriteConf(&buf), "No servers to write")
+}
+
+func TestChrystokiConfigWriteServerBundle(t *testing.T) {
+	cert1, cert2 := testCertPEM(t, "hsm1.example.com"), testCertPEM(t, "10.0.0.2")
+
+	conf := &ChrystokiConfig{Servers: []*ChrystokiServer{
+		{Name: "hsm1", Hostname: "hsm1.example.com", CertPEM: cert1},
+		{Name: "hsm2", Hostname: "10.0.0.2", CertPEM: cert2},
+	}}
+
+	var buf bytes.Buffer
+	if !assert.Nil(t, conf.WriteServerBundle(&buf)) {
+		return
+	}
+
+	assert.True(t, bytes.HasPrefix(buf.Bytes(), []byte("# hsm1 (hsm1.example.com)\n-----BEGIN CERTIFICATE-----")))
+
+	certs, err := parseCertsPEM(buf.Bytes())
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(certs)) {
+		assert.Equal(t, "hsm1.example.com", certs[0].Subject.CommonName)
+		assert.Equal(t, "10.0.0.2", certs[1].Subject.CommonName)
+	}
+}
+
+func TestNewChrystokiServer(t *testing.T) {
+	config := &Config{Nickname: "hsm1", Hostname: "hsm1.example.com"}
+
+	server, err := NewChrystokiServer(config, testCertPEM(t, "hsm1.example.com"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "hsm1", server.Name)
+		assert.Equal(t, NTLSPort, server.Port)
+	}
+
+	_, err = NewChrystokiServer(config, []byte("nope"))
+	assert.EqualError(t, err, "Bad NTLS certificate for hsm1: Error parsing certificate: no PEM encoded certificate found")
+}
+
+func TestParseHAGroup(t *testing.T) {
+	group, err := ParseHAGroup("app-ha=532018011, 1280742000001")
+	if assert.Nil(t, err) {
+		assert.Equal(t, &HAGroup{Label: "app-ha", Members: []string{"532018011", "1280742000001"}}, group)
+	}
+
+	_, err = ParseHAGroup("app-ha")
+	assert.EqualError(t, err, "Bad HA group 'app-ha'. Must be <label>=<partition serial>,...")
+
+	_, err = ParseHAGroup("app-ha=")
+	assert.EqualError(t, err, "HA group 'app-ha' has no members")
+
+	_, err = ParseHAGroup("app-ha=532018011,part1")
+	assert.EqualError(t, err, "Bad serial number 'part1' in HA group 'app-ha'")
+
+	_, err = ParseHAGroup("app ha=532018011")
+	assert.EqualError(t, err, "Bad HA group label")
+}
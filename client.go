@@ -1,8 +1,10 @@
 package lunash
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"os"
 	"strings"
 
 	"github.com/mastahyeti/lunash/scp"
@@ -14,6 +16,13 @@ import (
 type Client struct {
 	config *Config
 	client *ssh.Client
+
+	// xfer is how files are transferred, chosen on first use.
+	xfer transport
+
+	// pty runs a callback with a lunash shell. It's WithPTY, unless
+	// replaced by tests.
+	pty func(func(io.WriteCloser, io.Reader)) error
 }
 
 // newClient creates a Session from a Config.
@@ -29,39 +38,52 @@ func (c *Client) Connect() (err error) {
 
 // ScpGet gets the file at the given path from the HSM.
 func (c *Client) ScpGet(path string) ([]byte, error) {
-	var scpErr, sesErr error
-	var file []byte
-
-	sesErr = c.WithSession(func(session *ssh.Session) {
-		file, scpErr = scp.GetFile(session, path)
-	})
-
-	if scpErr != nil {
-		return nil, scpErr
-	}
-	if sesErr != nil {
-		return nil, sesErr
+	buf := bytes.NewBuffer(nil)
+	if _, err := c.ScpGetTo(path, buf); err != nil {
+		return nil, err
 	}
-
-	return file, nil
+	return buf.Bytes(), nil
 }
 
 // ScpPut writes a file onto the HSM.
 func (c *Client) ScpPut(path string, file []byte) error {
-	var scpErr, sesErr error
+	return c.ScpPutFrom(path, int64(len(file)), 0644, bytes.NewReader(file))
+}
 
-	sesErr = c.WithSession(func(session *ssh.Session) {
-		scpErr = scp.PutFile(session, path, file)
-	})
+// ScpGetTo streams the file at the given path on the HSM to w, returning its
+// mode, size and times.
+func (c *Client) ScpGetTo(path string, w io.Writer) (*scp.FileInfo, error) {
+	return c.ScpGetWithProgress(path, w, nil)
+}
 
-	if scpErr != nil {
-		return scpErr
-	}
-	if sesErr != nil {
-		return sesErr
-	}
+// ScpGetWithProgress is like ScpGetTo, but calls fn, if set, as the file is
+// received.
+func (c *Client) ScpGetWithProgress(path string, w io.Writer, fn scp.ProgressFunc) (*scp.FileInfo, error) {
+	return c.transport().get(path, w, fn)
+}
 
-	return nil
+// ScpPutFrom streams size bytes from r onto the HSM, creating a file with the
+// given mode.
+func (c *Client) ScpPutFrom(path string, size int64, mode os.FileMode, r io.Reader) error {
+	return c.ScpPutWithInfo(path, &scp.FileInfo{Mode: mode, Size: size}, r)
+}
+
+// ScpPutWithInfo streams info.Size bytes from r onto the HSM, creating a file
+// with info.Mode. If info.ModTime is set, the file's times are preserved too.
+func (c *Client) ScpPutWithInfo(path string, info *scp.FileInfo, r io.Reader) error {
+	return c.transport().put(path, info, r)
+}
+
+// ScpGetFiles gets several files from the HSM over one session, writing them
+// into the local directory dir.
+func (c *Client) ScpGetFiles(paths []string, dir string, opts scp.Options) error {
+	return c.transport().getFiles(paths, dir, opts)
+}
+
+// ScpPutFiles writes several local files into the directory dir on the HSM
+// over one session.
+func (c *Client) ScpPutFiles(paths []string, dir string, opts scp.Options) error {
+	return c.transport().putFiles(paths, dir, opts)
 }
 
 // Run runs multiple commands in an SSH PTY session and returns their outputs.
@@ -69,7 +91,12 @@ func (c *Client) Run(commands []string, login bool) ([]string, error) {
 	var runErr, ptyErr error
 	outputs := make([]string, 0, len(commands))
 
-	ptyErr = c.WithPTY(func(stdin io.WriteCloser, stdout io.Reader) {
+	pty := c.pty
+	if pty == nil {
+		pty = c.WithPTY
+	}
+
+	ptyErr = pty(func(stdin io.WriteCloser, stdout io.Reader) {
 		if _, err := readUntilPrompt(stdout); err != nil {
 			runErr = errors.Wrap(err, "Error reading shell banner")
 			return
@@ -100,13 +127,13 @@ func (c *Client) Run(commands []string, login bool) ([]string, error) {
 
 			_, err := stdin.Write([]byte(cmdWithNewline))
 			if err != nil {
-				runErr = errors.Wrap(err, fmt.Sprintf("Error sending command '%s'", cmd))
+				runErr = errors.Wrap(err, fmt.Sprintf("Error sending command '%s'", commandVerb(cmd)))
 				return
 			}
 
 			output, err := readUntilPrompt(stdout)
 			if err != nil {
-				runErr = fmt.Errorf("Error reading command output for '%s'", cmd)
+				runErr = fmt.Errorf("Error reading command output for '%s'", commandVerb(cmd))
 				return
 			}
 
@@ -117,7 +144,7 @@ func (c *Client) Run(commands []string, login bool) ([]string, error) {
 			status, output := lastLine(output)
 			const success = "Command Result : 0 (Success)"
 			if status != success {
-				runErr = fmt.Errorf("Non-success return code while running '%s'", cmd)
+				runErr = &CommandError{Command: commandVerb(cmd), Status: status, Output: output}
 			}
 
 			outputs = append(outputs, output)
@@ -136,6 +163,38 @@ func (c *Client) Run(commands []string, login bool) ([]string, error) {
 	return outputs, ptyErr
 }
 
+// CommandError is returned by Run when a command doesn't succeed.
+type CommandError struct {
+	// Command is the command without its arguments, which may include
+	// passwords, eg. "partition create".
+	Command string
+
+	// Status is the command's "Command Result" line.
+	Status string
+
+	// Output is the command's output, which usually explains the failure.
+	Output string
+}
+
+// Error implements the error interface.
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("Non-success return code while running '%s'", e.Command)
+}
+
+// commandVerb returns a command without its arguments, so it can be shown in
+// errors without revealing passwords. The verb is the words before the first
+// flag.
+func commandVerb(cmd string) string {
+	var words []string
+	for _, word := range strings.Fields(cmd) {
+		if strings.HasPrefix(word, "-") {
+			break
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
 // WithPTY calls the callback with an PTY SSH session.
 func (c *Client) WithPTY(cb func(io.WriteCloser, io.Reader)) error {
 	var ptyErr, sesErr error
@@ -203,6 +262,13 @@ func (c *Client) WithSession(cb func(*ssh.Session)) error {
 
 // Close closes the client connection.
 func (c *Client) Close() error {
+	if c.xfer != nil {
+		if err := c.xfer.close(); err != nil {
+			return errors.Wrap(err, "Error closing file transfers")
+		}
+		c.xfer = nil
+	}
+
 	if c.client != nil {
 		if err := c.client.Close(); err != nil {
 			return errors.Wrap(err, "Error closing client")
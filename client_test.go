@@ -1,6 +1,10 @@
 package lunash
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,3 +15,66 @@ func TestNewClient(t *testing.T) {
 	client := newClient(configs[0])
 	assert.Equal(t, configs[0], client.config)
 }
+
+// fakeShell pretends to be a lunash shell, answering each command with the
+// output and result from respond.
+func fakeShell(respond func(cmd string) (output string, ok bool)) func(func(io.WriteCloser, io.Reader)) error {
+	return func(cb func(io.WriteCloser, io.Reader)) error {
+		stdinR, stdinW := io.Pipe()
+		stdoutR, stdoutW := io.Pipe()
+
+		go func() {
+			defer stdoutW.Close()
+
+			fmt.Fprintf(stdoutW, "Last login: never\r\n\r\n%s", lunashPrompt)
+
+			lines := bufio.NewScanner(stdinR)
+			for lines.Scan() {
+				cmd := lines.Text()
+				if cmd == "exit" {
+					return
+				}
+
+				output, ok := respond(cmd)
+				status := "Command Result : 0 (Success)"
+				if !ok {
+					status = "Command Result : 65535 (Luna Shell execution)"
+				}
+				fmt.Fprintf(stdoutW, "%s\r\n%s\r\n\r\n%s\r\n%s", cmd, output, status, lunashPrompt)
+			}
+		}()
+
+		cb(stdinW, stdoutR)
+		return stdinW.Close()
+	}
+}
+
+func TestRunCommandErrorHidesArguments(t *testing.T) {
+	c := newClient(&Config{Hostname: "hsm1", Password: "adminpw"})
+	c.pty = fakeShell(func(cmd string) (string, bool) {
+		if strings.HasPrefix(cmd, "hsm login") {
+			return "'hsm login' successful.", true
+		}
+		return "Error: 'partition create' failed. Something unexpected happened.", false
+	})
+
+	_, err := c.Run([]string{"partition create -partition part1 -password s3cret -force"}, true)
+	if assert.IsType(t, &CommandError{}, err) {
+		assert.Equal(t, "partition create", err.(*CommandError).Command)
+		assert.Equal(t, "Command Result : 65535 (Luna Shell execution)", err.(*CommandError).Status)
+	}
+	assert.EqualError(t, err, "Non-success return code while running 'partition create'")
+
+	err = c.CreatePartition("part1", "s3cret", 0)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "s3cret")
+	assert.NotContains(t, fmt.Sprintf("%+v", err), "s3cret")
+	assert.NotContains(t, fmt.Sprintf("%+v", err), "adminpw")
+}
+
+func TestCommandVerb(t *testing.T) {
+	assert.Equal(t, "partition create", commandVerb("partition create -partition part1 -password s3cret"))
+	assert.Equal(t, "partition changepw", commandVerb("partition changepw -partition p -oldpw a -newpw b"))
+	assert.Equal(t, "hsm show", commandVerb("hsm show"))
+	assert.Equal(t, "hsm login", commandVerb("hsm login -p secret\n"))
+}
@@ -0,0 +1,171 @@
+package lunash
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Client certificate key types.
+const (
+	KeyTypeRSA   = "rsa"
+	KeyTypeECDSA = "ecdsa"
+)
+
+// ClientCertOptions are the options for GenerateClientCert.
+type ClientCertOptions struct {
+	// KeyType is KeyTypeRSA, the default, or KeyTypeECDSA.
+	KeyType string
+
+	// KeyBits is the RSA key size, 2048 by default, or the ECDSA curve
+	// size: 256, the default, 384 or 521.
+	KeyBits int
+
+	// Validity is how long the certificate is valid for, 10 years by
+	// default like vtl createCert.
+	Validity time.Duration
+}
+
+// ClientCert is a generated client key and certificate.
+type ClientCert struct {
+	Hostname string
+	CertPEM  []byte
+	KeyPEM   []byte
+	Cert     *x509.Certificate
+}
+
+// GenerateClientCert generates a key and self-signed certificate for an
+// application server to use as an NTLS client, like "vtl createCert". The
+// certificate's common name is the server's hostname or IP address, which is
+// how it's registered with RegisterClient.
+func GenerateClientCert(hostname string, opts ClientCertOptions) (*ClientCert, error) {
+	if err := checkArg("client host", hostname); err != nil {
+		return nil, err
+	}
+
+	if opts.Validity == 0 {
+		opts.Validity = 10 * 365 * 24 * time.Hour
+	}
+
+	var key crypto.Signer
+	var keyBlock *pem.Block
+	var err error
+
+	switch opts.KeyType {
+	case "", KeyTypeRSA:
+		if opts.KeyBits == 0 {
+			opts.KeyBits = 2048
+		}
+		if opts.KeyBits < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		var rsaKey *rsa.PrivateKey
+		if rsaKey, err = rsa.GenerateKey(rand.Reader, opts.KeyBits); err != nil {
+			return nil, errors.Wrap(err, "Error generating key")
+		}
+		key = rsaKey
+		keyBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	case KeyTypeECDSA:
+		curves := map[int]elliptic.Curve{0: elliptic.P256(), 256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}
+		curve, ok := curves[opts.KeyBits]
+		if !ok {
+			return nil, fmt.Errorf("Bad ECDSA key size %d. Must be 256, 384 or 521", opts.KeyBits)
+		}
+		var ecKey *ecdsa.PrivateKey
+		if ecKey, err = ecdsa.GenerateKey(curve, rand.Reader); err != nil {
+			return nil, errors.Wrap(err, "Error generating key")
+		}
+		der, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error encoding key")
+		}
+		key = ecKey
+		keyBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		return nil, fmt.Errorf("Bad key type '%s'. Must be %s or %s", opts.KeyType, KeyTypeRSA, KeyTypeECDSA)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating serial number")
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(opts.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating certificate")
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating certificate")
+	}
+
+	return &ClientCert{
+		Hostname: hostname,
+		CertPEM:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:   pem.EncodeToMemory(keyBlock),
+		Cert:     cert,
+	}, nil
+}
+
+// Write writes the certificate and key into dir as "<hostname>.pem" and
+// "<hostname>Key.pem", the names vtl uses. The key is only readable by the
+// owner, and an existing key is never overwritten.
+func (cc *ClientCert) Write(dir string) (certPath, keyPath string, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", "", errors.Wrap(err, "Error creating certificate directory")
+	}
+
+	certPath = filepath.Join(dir, cc.Hostname+".pem")
+	keyPath = filepath.Join(dir, cc.Hostname+"Key.pem")
+
+	if err = writeNewFile(keyPath, cc.KeyPEM, 0600); err != nil {
+		return "", "", err
+	}
+
+	if err = writeNewFile(certPath, cc.CertPEM, 0644); err != nil {
+		os.Remove(keyPath)
+		return "", "", err
+	}
+
+	return certPath, keyPath, nil
+}
+
+// writeNewFile writes a file that mustn't already exist.
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return errors.Wrap(err, "Error creating "+path)
+	}
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return errors.Wrap(err, "Error writing "+path)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,91 @@
+package lunash
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateClientCert(t *testing.T) {
+	cc, err := GenerateClientCert("app1.example.com", ClientCertOptions{})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, "app1.example.com", cc.Cert.Subject.CommonName)
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, cc.Cert.ExtKeyUsage)
+	if key, ok := cc.Cert.PublicKey.(*rsa.PublicKey); assert.True(t, ok) {
+		assert.Equal(t, 2048, key.N.BitLen())
+	}
+	assert.Contains(t, string(cc.KeyPEM), "RSA PRIVATE KEY")
+
+	_, err = tls.X509KeyPair(cc.CertPEM, cc.KeyPEM)
+	assert.Nil(t, err)
+
+	parsed, err := parseCertPEM(cc.CertPEM)
+	if assert.Nil(t, err) {
+		assert.Equal(t, cc.Cert.Raw, parsed.Raw)
+	}
+
+	cc, err = GenerateClientCert("10.1.2.3", ClientCertOptions{KeyType: KeyTypeECDSA, KeyBits: 384})
+	if assert.Nil(t, err) {
+		if key, ok := cc.Cert.PublicKey.(*ecdsa.PublicKey); assert.True(t, ok) {
+			assert.Equal(t, 384, key.Curve.Params().BitSize)
+		}
+		_, err = tls.X509KeyPair(cc.CertPEM, cc.KeyPEM)
+		assert.Nil(t, err)
+	}
+
+	_, err = GenerateClientCert("app1", ClientCertOptions{KeyType: "dsa"})
+	assert.EqualError(t, err, "Bad key type 'dsa'. Must be rsa or ecdsa")
+
+	_, err = GenerateClientCert("app1", ClientCertOptions{KeyBits: 1024})
+	assert.EqualError(t, err, "RSA keys must be at least 2048 bits")
+
+	_, err = GenerateClientCert("app1", ClientCertOptions{KeyType: KeyTypeECDSA, KeyBits: 128})
+	assert.EqualError(t, err, "Bad ECDSA key size 128. Must be 256, 384 or 521")
+
+	_, err = GenerateClientCert("app 1", ClientCertOptions{})
+	assert.EqualError(t, err, "Bad client host")
+}
+
+func TestClientCertWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lunash-clientcert")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cc, err := GenerateClientCert("app1.example.com", ClientCertOptions{KeyType: KeyTypeECDSA})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	certPath, keyPath, err := cc.Write(filepath.Join(dir, "client"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, filepath.Join(dir, "client", "app1.example.com.pem"), certPath)
+	assert.Equal(t, filepath.Join(dir, "client", "app1.example.comKey.pem"), keyPath)
+
+	if info, err := os.Stat(keyPath); assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	if data, err := ioutil.ReadFile(certPath); assert.Nil(t, err) {
+		assert.Equal(t, cc.CertPEM, data)
+	}
+
+	// Existing keys aren't overwritten.
+	_, _, err = cc.Write(filepath.Join(dir, "client"))
+	assert.NotNil(t, err)
+	if data, err := ioutil.ReadFile(keyPath); assert.Nil(t, err) {
+		assert.Equal(t, cc.KeyPEM, data)
+	}
+}
@@ -0,0 +1,521 @@
+package lunash
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mastahyeti/lunash/parse"
+	"github.com/pkg/errors"
+)
+
+// NTLSClient is an application server registered with the HSM for NTLS, as
+// shown by "client show".
+type NTLSClient struct {
+	Name     string
+	Hostname string
+	IP       string
+
+	// Fingerprint is the registered certificate's fingerprint, as shown by
+	// "client fingerprint". It's only set by Clients.
+	Fingerprint string
+
+	Partitions []string
+}
+
+// ClientChanges is what RegisterClient changed.
+type ClientChanges struct {
+	// Registered is set if the client was registered, either because it
+	// wasn't before or because its certificate or host changed.
+	Registered bool
+
+	// Mapped is set if the client's hostname was mapped to a new IP.
+	Mapped bool
+
+	Assigned []string
+	Revoked  []string
+}
+
+// Changed returns whether anything was changed.
+func (c *ClientChanges) Changed() bool {
+	return c.Registered || c.Mapped || len(c.Assigned) > 0 || len(c.Revoked) > 0
+}
+
+// ListClients lists the names of the registered clients.
+func (c *Client) ListClients() ([]string, error) {
+	outputs, err := c.Run([]string{"client list"}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range parse.Parse(outputs[0]).Fields() {
+		if strings.HasPrefix(strings.ToLower(f.Key), "registered client") {
+			names = append(names, f.Value)
+		}
+	}
+
+	return names, nil
+}
+
+// ShowClient returns the named registered client, or nil if there's no such
+// client.
+func (c *Client) ShowClient(name string) (*NTLSClient, error) {
+	if err := checkArg("client name", name); err != nil {
+		return nil, err
+	}
+
+	outputs, err := c.Run([]string{fmt.Sprintf("client show -client %s", name)}, false)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return parseClientShow(outputs[0])
+}
+
+// RegisterClient registers an application server with the HSM for NTLS and
+// assigns it exactly the given partitions. The host is the server's hostname
+// or IP address, which must match the certificate's common name or one of its
+// SANs.
+//
+// It's safe to run repeatedly: a client that's already registered with the
+// same certificate and host is left alone, and only the differences in its
+// partitions are assigned or revoked. A client registered with a different
+// certificate or host is deleted and registered again.
+func (c *Client) RegisterClient(name, host string, certPEM []byte, partitions []string) (*ClientChanges, error) {
+	if err := checkArg("client name", name); err != nil {
+		return nil, err
+	}
+	if err := checkArg("client host", host); err != nil {
+		return nil, err
+	}
+	for _, partition := range partitions {
+		if err := checkArg("partition name", partition); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := parseCertPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !certMatchesHost(cert, host) {
+		return nil, fmt.Errorf("Certificate for '%s' doesn't match client host '%s'", cert.Subject.CommonName, host)
+	}
+
+	existing, err := c.ShowClient(name)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &ClientChanges{}
+
+	if existing != nil {
+		same, err := c.sameClient(existing, host, cert)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			if err = c.DeregisterClient(name); err != nil {
+				return nil, err
+			}
+			existing = nil
+		}
+	}
+
+	if existing == nil {
+		if err = c.registerClient(name, host, certPEM); err != nil {
+			return nil, err
+		}
+		changes.Registered = true
+		existing = &NTLSClient{Name: name}
+	}
+
+	changes.Assigned, changes.Revoked = diffPartitions(existing.Partitions, partitions)
+
+	cmds := make([]string, 0, len(changes.Assigned)+len(changes.Revoked))
+	for _, partition := range changes.Assigned {
+		cmds = append(cmds, fmt.Sprintf("client assignPartition -client %s -partition %s", name, partition))
+	}
+	for _, partition := range changes.Revoked {
+		cmds = append(cmds, fmt.Sprintf("client revokePartition -client %s -partition %s", name, partition))
+	}
+
+	if len(cmds) > 0 {
+		if _, err = c.Run(cmds, false); err != nil {
+			return changes, errors.Wrap(err, fmt.Sprintf("Error assigning partitions to client '%s'", name))
+		}
+	}
+
+	return changes, nil
+}
+
+// certMatchesHost returns whether the certificate's common name, or one of its
+// DNS or IP address SANs, is host. NTLS rejects clients whose certificates
+// don't match.
+func certMatchesHost(cert *x509.Certificate, host string) bool {
+	if strings.EqualFold(cert.Subject.CommonName, host) {
+		return true
+	}
+
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, host) {
+			return true
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, certIP := range cert.IPAddresses {
+			if certIP.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// MapClientIP maps a client registered by hostname to an IP address, for
+// servers whose NTLS connections come from an address that doesn't resolve
+// to the hostname. It returns whether the mapping changed.
+func (c *Client) MapClientIP(name, ip string) (bool, error) {
+	if net.ParseIP(ip) == nil {
+		return false, fmt.Errorf("Bad IP address '%s'", ip)
+	}
+
+	existing, err := c.ShowClient(name)
+	if err != nil {
+		return false, err
+	}
+	if existing == nil {
+		return false, fmt.Errorf("Client '%s' isn't registered", name)
+	}
+	if existing.IP == ip {
+		return false, nil
+	}
+
+	_, err = c.Run([]string{fmt.Sprintf("client hostip map -client %s -ip %s", name, ip)}, false)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("Error mapping client '%s' to %s", name, ip))
+	}
+
+	return true, nil
+}
+
+// DeregisterClient deletes a registered client, which also revokes its
+// partitions. Clients that aren't registered are ignored.
+func (c *Client) DeregisterClient(name string) error {
+	if err := checkArg("client name", name); err != nil {
+		return err
+	}
+
+	_, err := c.Run([]string{fmt.Sprintf("client delete -client %s -force", name)}, false)
+	if err != nil && !isNotFound(err) {
+		return errors.Wrap(err, fmt.Sprintf("Error deleting client '%s'", name))
+	}
+
+	return nil
+}
+
+// registerClient uploads the client's certificate and registers it. lunash
+// looks for the certificate in the file area as "<host>.pem".
+func (c *Client) registerClient(name, host string, certPEM []byte) error {
+	certFile := host + ".pem"
+	if err := c.ScpPut(certFile, certPEM); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error uploading certificate for client '%s'", name))
+	}
+
+	hostFlag := "-hostname"
+	if net.ParseIP(host) != nil {
+		hostFlag = "-ip"
+	}
+
+	_, err := c.Run([]string{fmt.Sprintf("client register -client %s %s %s", name, hostFlag, host)}, false)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error registering client '%s'", name))
+	}
+
+	if err = c.DeleteFile(certFile); err != nil {
+		log.Printf("Error deleting %s after registering client '%s': %s", certFile, name, err)
+	}
+
+	return nil
+}
+
+// sameClient returns whether a registered client has the given host and
+// certificate.
+func (c *Client) sameClient(existing *NTLSClient, host string, cert *x509.Certificate) (bool, error) {
+	if existing.Hostname != host && existing.IP != host {
+		return false, nil
+	}
+
+	fingerprint, err := c.ClientFingerprint(existing.Name)
+	if err != nil {
+		return false, err
+	}
+
+	return fingerprintMatches(fingerprint, cert), nil
+}
+
+// ClientFingerprint returns the fingerprint of a registered client's
+// certificate.
+func (c *Client) ClientFingerprint(name string) (string, error) {
+	if err := checkArg("client name", name); err != nil {
+		return "", err
+	}
+
+	outputs, err := c.Run([]string{fmt.Sprintf("client fingerprint -client %s", name)}, false)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("Error reading fingerprint of client '%s'", name))
+	}
+
+	return parseFingerprint(outputs[0])
+}
+
+// Clients returns every registered client, with its certificate's
+// fingerprint.
+func (c *Client) Clients() ([]NTLSClient, error) {
+	names, err := c.ListClients()
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	cmds := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		if err = checkArg("client name", name); err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, fmt.Sprintf("client show -client %s", name), fmt.Sprintf("client fingerprint -client %s", name))
+	}
+
+	outputs, err := c.Run(cmds, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading clients")
+	}
+
+	clients := make([]NTLSClient, 0, len(names))
+	for i := 0; i+1 < len(outputs); i += 2 {
+		client, err := parseClientShow(outputs[i])
+		if err != nil {
+			return nil, err
+		}
+		if client.Fingerprint, err = parseFingerprint(outputs[i+1]); err != nil {
+			return nil, err
+		}
+		clients = append(clients, *client)
+	}
+
+	return clients, nil
+}
+
+// parseFingerprint parses the output of "client fingerprint".
+func parseFingerprint(output string) (string, error) {
+	fingerprint, ok := parse.Parse(output).Get("Certificate fingerprint")
+	if !ok || fingerprint == "" {
+		return "", fmt.Errorf("Error parsing 'client fingerprint' output: no fingerprint")
+	}
+	return fingerprint, nil
+}
+
+// fingerprintMatches returns whether a fingerprint shown by lunash is the
+// certificate's. The hash depends on the appliance version, so it's chosen by
+// the fingerprint's length.
+func fingerprintMatches(fingerprint string, cert *x509.Certificate) bool {
+	want, err := hex.DecodeString(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+	if err != nil {
+		return false
+	}
+
+	var got []byte
+	switch len(want) {
+	case md5.Size:
+		sum := md5.Sum(cert.Raw)
+		got = sum[:]
+	case sha1.Size:
+		sum := sha1.Sum(cert.Raw)
+		got = sum[:]
+	case sha256.Size:
+		sum := sha256.Sum256(cert.Raw)
+		got = sum[:]
+	default:
+		return false
+	}
+
+	return bytes.Equal(got, want)
+}
+
+// parseCertPEM parses a PEM encoded certificate.
+func parseCertPEM(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("Error parsing certificate: no PEM encoded certificate found")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing certificate")
+	}
+
+	return cert, nil
+}
+
+// parseClientShow parses the output of "client show". The field names differ
+// from Luna 7 on.
+func parseClientShow(output string) (*NTLSClient, error) {
+	fields := parse.Parse(output).Fields()
+
+	client := &NTLSClient{
+		Name:     lookup(fields, "ClientID", "Client ID", "Client Name"),
+		Hostname: lookup(fields, "HostName", "Host Name"),
+		IP:       lookup(fields, "IPAddress", "IP Address"),
+	}
+
+	if client.Name == "" {
+		return nil, fmt.Errorf("Error parsing 'client show' output: no client name")
+	}
+
+	// Partitions: "part1", "part2"
+	partitions := lookup(fields, "Partitions")
+	if !strings.EqualFold(partitions, "None") {
+		for _, partition := range strings.Split(partitions, ",") {
+			if partition = strings.Trim(strings.TrimSpace(partition), `"`); partition != "" {
+				client.Partitions = append(client.Partitions, partition)
+			}
+		}
+	}
+
+	return client, nil
+}
+
+// diffPartitions returns the partitions to assign and revoke to change a
+// client's partitions to the desired ones, in sorted order.
+func diffPartitions(current, desired []string) (assign, revoke []string) {
+	have := make(map[string]bool, len(current))
+	for _, partition := range current {
+		have[partition] = true
+	}
+	want := make(map[string]bool, len(desired))
+	for _, partition := range desired {
+		want[partition] = true
+	}
+
+	for partition := range want {
+		if !have[partition] {
+			assign = append(assign, partition)
+		}
+	}
+	for partition := range have {
+		if !want[partition] {
+			revoke = append(revoke, partition)
+		}
+	}
+
+	sort.Strings(assign)
+	sort.Strings(revoke)
+	return assign, revoke
+}
+
+// isNotFound returns whether a command failed because what it named doesn't
+// exist.
+func isNotFound(err error) bool {
+	cmdErr, ok := err.(*CommandError)
+	if !ok {
+		return false
+	}
+
+	output := strings.ToLower(cmdErr.Output)
+	return strings.Contains(output, "does not exist") || strings.Contains(output, "not found") || strings.Contains(output, "not registered")
+}
+
+// ClientInventory is the clients registered with one HSM.
+type ClientInventory struct {
+	HSM     string
+	Clients []NTLSClient
+}
+
+// ClientMatrix shows which clients can reach which partitions across many
+// HSMs.
+type ClientMatrix struct {
+	// Partitions are the columns, as "<HSM>/<partition>", in sorted order.
+	// Only partitions assigned to some client are included.
+	Partitions []string
+	Rows       []ClientMatrixRow
+}
+
+// ClientMatrixRow is a client's access to the matrix's partitions.
+type ClientMatrixRow struct {
+	Client   string
+	Hostname string
+	IP       string
+
+	// Access has an entry for each of the matrix's partitions, set if
+	// it's assigned to the client.
+	Access []bool
+}
+
+// NewClientMatrix builds the client-to-partition matrix from the clients
+// registered with each HSM. Clients are matched across HSMs by name and
+// sorted by it.
+func NewClientMatrix(inventories []ClientInventory) *ClientMatrix {
+	rows := make(map[string]*ClientMatrixRow)
+	assigned := make(map[string]map[string]bool)
+	columns := make(map[string]bool)
+
+	for _, inventory := range inventories {
+		for _, client := range inventory.Clients {
+			row, ok := rows[client.Name]
+			if !ok {
+				row = &ClientMatrixRow{Client: client.Name}
+				rows[client.Name] = row
+				assigned[client.Name] = make(map[string]bool)
+			}
+			if row.Hostname == "" {
+				row.Hostname = client.Hostname
+			}
+			if row.IP == "" {
+				row.IP = client.IP
+			}
+
+			for _, partition := range client.Partitions {
+				column := inventory.HSM + "/" + partition
+				columns[column] = true
+				assigned[client.Name][column] = true
+			}
+		}
+	}
+
+	matrix := &ClientMatrix{}
+	for column := range columns {
+		matrix.Partitions = append(matrix.Partitions, column)
+	}
+	sort.Strings(matrix.Partitions)
+
+	names := make([]string, 0, len(rows))
+	for name := range rows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		row := rows[name]
+		row.Access = make([]bool, len(matrix.Partitions))
+		for i, column := range matrix.Partitions {
+			row.Access[i] = assigned[name][column]
+		}
+		matrix.Rows = append(matrix.Rows, *row)
+	}
+
+	return matrix
+}
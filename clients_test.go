@@ -0,0 +1,177 @@
+package lunash
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertPEM returns a self-signed certificate for the given common name.
+func testCertPEM(t *testing.T, cn string) []byte {
+	certPEM, _ := testCertKey(t, cn, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	return certPEM
+}
+
+// testCertKey returns a self-signed certificate valid between the given
+// times, and its PEM encoded key.
+func testCertKey(t *testing.T, cn string, notBefore, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertMatchesHost(t *testing.T) {
+	cert, err := parseCertPEM(testCertPEM(t, "app1.example.com"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, certMatchesHost(cert, "app1.example.com"))
+	assert.True(t, certMatchesHost(cert, "APP1.example.com"))
+	assert.False(t, certMatchesHost(cert, "app2.example.com"))
+
+	cert.DNSNames = []string{"app1.internal"}
+	cert.IPAddresses = []net.IP{net.ParseIP("10.0.0.5")}
+	assert.True(t, certMatchesHost(cert, "app1.internal"))
+	assert.True(t, certMatchesHost(cert, "10.0.0.5"))
+	assert.False(t, certMatchesHost(cert, "10.0.0.6"))
+}
+
+func TestRegisterClientHostMismatch(t *testing.T) {
+	// The certificate is checked before connecting to the HSM.
+	c := newClient(&Config{Hostname: "hsm1"})
+	_, err := c.RegisterClient("app1", "app2.example.com", testCertPEM(t, "app1.example.com"), []string{"part1"})
+	assert.EqualError(t, err, "Certificate for 'app1.example.com' doesn't match client host 'app2.example.com'")
+}
+
+func TestParseClientShow(t *testing.T) {
+	client, err := parseClientShow(readParseTestdata(t, "client_show.txt"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, &NTLSClient{
+			Name:       "app1",
+			Hostname:   "app1.example.com",
+			IP:         "10.1.2.3",
+			Partitions: []string{"part1", "part2"},
+		}, client)
+	}
+
+	client, err = parseClientShow(readParseTestdata(t, "client_show_luna7.txt"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, &NTLSClient{Name: "app2", Hostname: "app2.example.com"}, client)
+	}
+
+	_, err = parseClientShow("\n")
+	assert.EqualError(t, err, "Error parsing 'client show' output: no client name")
+}
+
+func TestFingerprintMatches(t *testing.T) {
+	cert, err := parseCertPEM(testCertPEM(t, "app1.example.com"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	colons := func(sum []byte) string {
+		hex := make([]string, len(sum))
+		for i, b := range sum {
+			hex[i] = fmt.Sprintf("%02X", b)
+		}
+		return strings.Join(hex, ":")
+	}
+
+	sha1Sum := sha1.Sum(cert.Raw)
+	sha256Sum := sha256.Sum256(cert.Raw)
+
+	assert.True(t, fingerprintMatches(colons(sha1Sum[:]), cert))
+	assert.True(t, fingerprintMatches(colons(sha256Sum[:]), cert))
+	assert.False(t, fingerprintMatches("9C:3B:61:0A:7E:44:D2:19:8F:05:B6:E1:2A:C4:77:30:5D:8E:19:F2", cert))
+	assert.False(t, fingerprintMatches("not a fingerprint", cert))
+}
+
+func TestParseCertPEM(t *testing.T) {
+	cert, err := parseCertPEM(testCertPEM(t, "app1.example.com"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "app1.example.com", cert.Subject.CommonName)
+	}
+
+	_, err = parseCertPEM([]byte("nope"))
+	assert.EqualError(t, err, "Error parsing certificate: no PEM encoded certificate found")
+}
+
+func TestDiffPartitions(t *testing.T) {
+	assign, revoke := diffPartitions([]string{"part1", "part2"}, []string{"part3", "part1"})
+	assert.Equal(t, []string{"part3"}, assign)
+	assert.Equal(t, []string{"part2"}, revoke)
+
+	assign, revoke = diffPartitions([]string{"part1"}, []string{"part1"})
+	assert.Empty(t, assign)
+	assert.Empty(t, revoke)
+}
+
+func TestIsNotFound(t *testing.T) {
+	assert.True(t, isNotFound(&CommandError{Output: "Error: Client app1 does not exist."}))
+	assert.False(t, isNotFound(&CommandError{Output: "Error: something else"}))
+	assert.False(t, isNotFound(fmt.Errorf("does not exist")))
+}
+
+func TestParseFingerprint(t *testing.T) {
+	fingerprint, err := parseFingerprint(readParseTestdata(t, "client_fingerprint.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "9C:3B:61:0A:7E:44:D2:19:8F:05:B6:E1:2A:C4:77:30:5D:8E:19:F2", fingerprint)
+
+	_, err = parseFingerprint("\n")
+	assert.EqualError(t, err, "Error parsing 'client fingerprint' output: no fingerprint")
+}
+
+func TestNewClientMatrix(t *testing.T) {
+	matrix := NewClientMatrix([]ClientInventory{
+		{HSM: "hsm2", Clients: []NTLSClient{
+			{Name: "app2", Hostname: "app2.example.com", Partitions: []string{"part1"}},
+			{Name: "app1", Hostname: "app1.example.com", IP: "10.1.2.3", Partitions: []string{"part1"}},
+		}},
+		{HSM: "hsm1", Clients: []NTLSClient{
+			{Name: "app1", Hostname: "app1.example.com", Partitions: []string{"part2", "part1"}},
+			{Name: "idle", Hostname: "idle.example.com"},
+		}},
+	})
+
+	assert.Equal(t, &ClientMatrix{
+		Partitions: []string{"hsm1/part1", "hsm1/part2", "hsm2/part1"},
+		Rows: []ClientMatrixRow{
+			{Client: "app1", Hostname: "app1.example.com", IP: "10.1.2.3", Access: []bool{true, true, true}},
+			{Client: "app2", Hostname: "app2.example.com", Access: []bool{false, false, true}},
+			{Client: "idle", Hostname: "idle.example.com", Access: []bool{false, false, false}},
+		},
+	}, matrix)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mastahyeti/lunash"
+)
+
+var certCommands = map[string]command{
+	"check": certCheck,
+}
+
+func certCommand(args []string) {
+	dispatch("luna cert", certCommands, args)
+}
+
+// hsmCerts is the certificates fetched from one HSM.
+type hsmCerts struct {
+	HSM   string             `json:"hsm"`
+	Certs []*lunash.CertInfo `json:"certs"`
+	Error string             `json:"error,omitempty"`
+}
+
+// certCheck reports the NTLS and configured certificates of many HSMs, exiting
+// with the worst certificate's status for monitoring systems: 0 if all are
+// OK, 1 for a warning, 2 if critical and 3 if an HSM couldn't be checked.
+// Critical certificates take precedence over HSMs that couldn't be checked.
+func certCheck(args []string) {
+	flags := flag.NewFlagSet("luna cert check", flag.ExitOnError)
+	namesArg := flags.String("names", "", "comma separated list of HSMs to check")
+	allArg := flags.Bool("all", false, "check all HSMs in the config file")
+	warnArg := flags.Int("warn", 30, "warn about certificates expiring within this many days")
+	critArg := flags.Int("crit", 7, "report certificates expiring within this many days as critical")
+	parallelArg := flags.Int("parallel", 10, "how many HSMs to check at once")
+	jsonArg := flags.Bool("json", false, "output JSON instead of a table")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	if *critArg > *warnArg {
+		fmt.Fprintf(os.Stderr, "-crit (%d days) can't be more than -warn (%d days)\n", *critArg, *warnArg)
+		os.Exit(int(lunash.CertUnknown))
+	}
+
+	configs := loadConfigs(flags, *confArg, *namesArg, *allArg)
+	now := time.Now()
+
+	checked := make([]hsmCerts, len(configs))
+
+	results := lunash.ForEachIndex(configs, *parallelArg, func(i int, config *lunash.Config, client *lunash.Client) error {
+		certs, err := client.InspectCerts(now)
+		checked[i].Certs = certs
+		return err
+	})
+
+	status := lunash.CertOK
+	for i, result := range results {
+		checked[i].HSM = result.Config.Name()
+		if result.Err != nil {
+			checked[i].Error = result.Err.Error()
+			if lunash.CertUnknown.Worse(status) {
+				status = lunash.CertUnknown
+			}
+		}
+		for _, cert := range checked[i].Certs {
+			if s := cert.Status(*warnArg, *critArg); s.Worse(status) {
+				status = s
+			}
+		}
+	}
+
+	if *jsonArg {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(checked); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		writeCertTable(checked, *warnArg, *critArg)
+	}
+
+	os.Exit(int(status))
+}
+
+func writeCertTable(checked []hsmCerts, warnDays, critDays int) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tHSM\tPATH\tSUBJECT\tNAMES\tKEY\tNOT BEFORE\tNOT AFTER\tDAYS LEFT")
+
+	for _, hsm := range checked {
+		if hsm.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\t\t%s\n", lunash.CertUnknown, hsm.HSM, hsm.Error)
+		}
+
+		for _, cert := range hsm.Certs {
+			names := strings.Join(append(append([]string{}, cert.DNSNames...), cert.IPs...), ",")
+			if names == "" {
+				names = "-"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s %d\t%s\t%s\t%d\n",
+				cert.Status(warnDays, critDays), hsm.HSM, cert.Path, cert.Subject, names,
+				cert.KeyType, cert.KeyBits,
+				cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02"), cert.DaysLeft)
+		}
+	}
+
+	w.Flush()
+}
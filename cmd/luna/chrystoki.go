@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mastahyeti/lunash"
+	"github.com/pkg/errors"
+)
+
+// haGroups collects repeated -ha flags.
+type haGroups []*lunash.HAGroup
+
+func (g *haGroups) String() string { return "" }
+
+func (g *haGroups) Set(spec string) error {
+	group, err := lunash.ParseHAGroup(spec)
+	if err != nil {
+		return err
+	}
+	*g = append(*g, group)
+	return nil
+}
+
+// chrystokiCommand writes a Luna client's Chrystoki.conf server entries and
+// server certificate bundle for a set of HSMs.
+func chrystokiCommand(args []string) {
+	var groups haGroups
+
+	flags := flag.NewFlagSet("luna chrystoki", flag.ExitOnError)
+	namesArg := flags.String("names", "", "comma separated list of HSMs the client connects to")
+	allArg := flags.Bool("all", false, "use all HSMs in the config file")
+	clientArg := flags.String("client", "", "the client's hostname, which names its certificate and key files")
+	certDirArg := flags.String("cert-dir", lunash.DefaultLunaCertDir, "the Luna client's certificate directory")
+	certsArg := flags.String("certs", "", "directory of server.pem files fetched with lunascp-get -dir, instead of fetching them")
+	storeArg := flags.Bool("store", false, "use the latest server.pem files in the artifact store, instead of fetching them")
+	outArg := flags.String("out", "", "directory to write Chrystoki.conf and server/CAFile.pem into, instead of stdout")
+	printArg := flags.String("print", "conf", "without -out, what to write to stdout: conf or bundle")
+	parallelArg := flags.Int("parallel", 10, "how many HSMs to fetch certificates from at once")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Var(&groups, "ha", "HA group as <label>=<partition serial>,..., may be repeated")
+	flags.Parse(args)
+
+	if *clientArg == "" || (*outArg == "" && *printArg != "conf" && *printArg != "bundle") {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	configs := loadConfigs(flags, *confArg, *namesArg, *allArg)
+
+	var certs [][]byte
+	switch {
+	case *certsArg != "":
+		certs = readServerCerts(configs, *certsArg)
+	case *storeArg:
+		certs = storedServerCerts(configs)
+	default:
+		certs = fetchServerCerts(configs, *parallelArg)
+	}
+
+	conf := &lunash.ChrystokiConfig{
+		HAGroups: groups,
+		Client:   *clientArg,
+		CertDir:  *certDirArg,
+	}
+	for i, config := range configs {
+		server, err := lunash.NewChrystokiServer(config, certs[i])
+		if err != nil {
+			log.Fatal(err)
+		}
+		conf.Servers = append(conf.Servers, server)
+	}
+
+	if *outArg == "" {
+		var err error
+		if *printArg == "bundle" {
+			err = conf.WriteServerBundle(os.Stdout)
+		} else {
+			err = conf.WriteConf(os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	writeChrystokiFiles(conf, *outArg)
+}
+
+// writeChrystokiFiles writes Chrystoki.conf and server/CAFile.pem into dir.
+func writeChrystokiFiles(conf *lunash.ChrystokiConfig, dir string) {
+	if err := os.MkdirAll(filepath.Join(dir, "server"), 0755); err != nil {
+		log.Fatal(errors.Wrap(err, "Error creating output directory"))
+	}
+
+	files := []struct {
+		path  string
+		write func(*os.File) error
+	}{
+		{filepath.Join(dir, "Chrystoki.conf"), func(f *os.File) error { return conf.WriteConf(f) }},
+		{filepath.Join(dir, "server", "CAFile.pem"), func(f *os.File) error { return conf.WriteServerBundle(f) }},
+	}
+
+	for _, file := range files {
+		f, err := os.Create(file.path)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Error creating "+file.path))
+		}
+		if err = file.write(f); err != nil {
+			f.Close()
+			log.Fatal(err)
+		}
+		if err = f.Close(); err != nil {
+			log.Fatal(errors.Wrap(err, "Error writing "+file.path))
+		}
+		log.Printf("Wrote %s", file.path)
+	}
+}
+
+// readServerCerts reads each HSM's server.pem from <dir>/<name>/server.pem.
+func readServerCerts(configs []*lunash.Config, dir string) [][]byte {
+	certs := make([][]byte, len(configs))
+	for i, config := range configs {
+		path := filepath.Join(dir, config.Name(), lunash.NTLSCertPath)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Error reading server certificate"))
+		}
+		certs[i] = data
+	}
+	return certs
+}
+
+// storedServerCerts reads the latest version of each HSM's server.pem from
+// the artifact store.
+func storedServerCerts(configs []*lunash.Config) [][]byte {
+	store := openStore("")
+
+	certs := make([][]byte, len(configs))
+	for i, config := range configs {
+		versions, err := store.Versions(config.Name(), lunash.NTLSCertPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(versions) == 0 {
+			log.Fatalf("No %s for %s in the artifact store", lunash.NTLSCertPath, config.Name())
+		}
+
+		if certs[i], err = store.Read(&versions[len(versions)-1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return certs
+}
+
+// fetchServerCerts fetches each HSM's server.pem.
+func fetchServerCerts(configs []*lunash.Config, parallel int) [][]byte {
+	certs := make([][]byte, len(configs))
+
+	results := lunash.ForEachIndex(configs, parallel, func(i int, config *lunash.Config, client *lunash.Client) error {
+		certPEM, _, err := client.NTLSCert()
+		certs[i] = certPEM
+		return err
+	})
+	report(results)
+
+	return certs
+}
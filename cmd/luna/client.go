@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mastahyeti/lunash"
+	"github.com/pkg/errors"
+)
+
+var clientCommands = map[string]command{
+	"list":        clientList,
+	"show":        clientShow,
+	"register":    clientRegister,
+	"deregister":  clientDeregister,
+	"report":      clientReport,
+	"create-cert": clientCreateCert,
+}
+
+func clientCommand(args []string) {
+	dispatch("luna client", clientCommands, args)
+}
+
+// clientList lists the NTLS clients registered with an HSM.
+func clientList(args []string) {
+	flags := flag.NewFlagSet("luna client list", flag.ExitOnError)
+	nameArg := flags.String("name", "", "name of HSM")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	client := connect(flags, *confArg, *nameArg)
+	defer client.Close()
+
+	names, err := client.ListClients()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
+
+// clientShow shows a registered NTLS client.
+func clientShow(args []string) {
+	flags := flag.NewFlagSet("luna client show", flag.ExitOnError)
+	nameArg := flags.String("name", "", "name of HSM")
+	clientArg := flags.String("client", "", "name of the registered client")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	client := connect(flags, *confArg, *nameArg)
+	defer client.Close()
+
+	ntls, err := client.ShowClient(*clientArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ntls == nil {
+		log.Fatalf("Client '%s' isn't registered", *clientArg)
+	}
+
+	fmt.Printf("Client:      %s\n", ntls.Name)
+	fmt.Printf("Hostname:    %s\n", ntls.Hostname)
+	fmt.Printf("IP:          %s\n", ntls.IP)
+	fmt.Printf("Partitions:  %s\n", strings.Join(ntls.Partitions, ", "))
+}
+
+// clientRegister registers an application server and assigns its
+// partitions, changing only what differs from an existing registration.
+func clientRegister(args []string) {
+	flags := flag.NewFlagSet("luna client register", flag.ExitOnError)
+	nameArg := flags.String("name", "", "name of HSM")
+	clientArg := flags.String("client", "", "name to register the client as")
+	hostArg := flags.String("host", "", "the client's hostname or IP address, matching its certificate's common name")
+	certArg := flags.String("cert", "", "path to the client's PEM encoded certificate")
+	partitionsArg := flags.String("partitions", "", "comma separated list of partitions to assign to the client")
+	ipArg := flags.String("ip", "", "IP address to map a client registered by hostname to")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	if *clientArg == "" || *hostArg == "" || *certArg == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	certPEM, err := ioutil.ReadFile(*certArg)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Error reading certificate"))
+	}
+
+	var partitions []string
+	if *partitionsArg != "" {
+		partitions = strings.Split(*partitionsArg, ",")
+	}
+
+	client := connect(flags, *confArg, *nameArg)
+	defer client.Close()
+
+	changes, err := client.RegisterClient(*clientArg, *hostArg, certPEM, partitions)
+	if err != nil {
+		client.Close()
+		log.Fatal(err)
+	}
+
+	if *ipArg != "" {
+		if changes.Mapped, err = client.MapClientIP(*clientArg, *ipArg); err != nil {
+			client.Close()
+			log.Fatal(err)
+		}
+	}
+
+	logClientChanges(*clientArg, *ipArg, changes)
+}
+
+// logClientChanges logs what registering a client changed.
+func logClientChanges(name, ip string, changes *lunash.ClientChanges) {
+	if changes.Registered {
+		log.Printf("Registered client '%s'", name)
+	}
+	if changes.Mapped {
+		log.Printf("Mapped client '%s' to %s", name, ip)
+	}
+	for _, partition := range changes.Assigned {
+		log.Printf("Assigned partition '%s'", partition)
+	}
+	for _, partition := range changes.Revoked {
+		log.Printf("Revoked partition '%s'", partition)
+	}
+	if !changes.Changed() {
+		log.Printf("Client '%s' is already registered", name)
+	}
+}
+
+// clientDeregister deletes registered NTLS clients.
+func clientDeregister(args []string) {
+	flags := flag.NewFlagSet("luna client deregister", flag.ExitOnError)
+	nameArg := flags.String("name", "", "name of HSM")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	client := connect(flags, *confArg, *nameArg)
+	defer client.Close()
+
+	for _, name := range flags.Args() {
+		if err := client.DeregisterClient(name); err != nil {
+			client.Close()
+			log.Fatal(err)
+		}
+	}
+}
+
+// clientCreateCert generates a client key and certificate, like vtl
+// createCert, and optionally registers the client with an HSM.
+func clientCreateCert(args []string) {
+	flags := flag.NewFlagSet("luna client create-cert", flag.ExitOnError)
+	hostArg := flags.String("host", "", "the client's hostname or IP address, used as the certificate's common name")
+	dirArg := flags.String("dir", ".", "directory to write <host>.pem and <host>Key.pem into")
+	keyTypeArg := flags.String("key-type", lunash.KeyTypeRSA, "key type: rsa or ecdsa")
+	bitsArg := flags.Int("bits", 0, "RSA key size (default 2048) or ECDSA curve size (default 256)")
+	daysArg := flags.Int("days", 3650, "how many days the certificate is valid for (at least 1)")
+	nameArg := flags.String("name", "", "name of HSM to register the client with, if any")
+	clientArg := flags.String("client", "", "name to register the client as (defaults to -host)")
+	partitionsArg := flags.String("partitions", "", "comma separated list of partitions to assign to the client")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	if *hostArg == "" || *daysArg < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	cc, err := lunash.GenerateClientCert(*hostArg, lunash.ClientCertOptions{
+		KeyType:  *keyTypeArg,
+		KeyBits:  *bitsArg,
+		Validity: time.Duration(*daysArg) * 24 * time.Hour,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	certPath, keyPath, err := cc.Write(*dirArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %s and %s", certPath, keyPath)
+	log.Printf("  SHA-256 %s", lunash.CertFingerprint(cc.Cert))
+
+	if *nameArg == "" {
+		return
+	}
+
+	name := *clientArg
+	if name == "" {
+		name = *hostArg
+	}
+
+	var partitions []string
+	if *partitionsArg != "" {
+		partitions = strings.Split(*partitionsArg, ",")
+	}
+
+	client := connect(flags, *confArg, *nameArg)
+	defer client.Close()
+
+	changes, err := client.RegisterClient(name, *hostArg, cc.CertPEM, partitions)
+	if err != nil {
+		client.Close()
+		log.Fatal(err)
+	}
+
+	logClientChanges(name, "", changes)
+}
+
+// clientReport prints the client-to-partition matrix across many HSMs.
+func clientReport(args []string) {
+	flags := flag.NewFlagSet("luna client report", flag.ExitOnError)
+	namesArg := flags.String("names", "", "comma separated list of HSMs to report on")
+	allArg := flags.Bool("all", false, "report on all HSMs in the config file")
+	parallelArg := flags.Int("parallel", 10, "how many HSMs to query at once")
+	formatArg := flags.String("format", "text", "output format: text, csv, or json for every client's details")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	configs := loadConfigs(flags, *confArg, *namesArg, *allArg)
+
+	inventories := make([]lunash.ClientInventory, len(configs))
+	for i, config := range configs {
+		inventories[i].HSM = config.Name()
+	}
+
+	// Each HSM writes only its own inventory, so no locking is needed.
+	results := lunash.ForEachIndex(configs, *parallelArg, func(i int, config *lunash.Config, client *lunash.Client) error {
+		clients, err := client.Clients()
+		if err != nil {
+			return err
+		}
+
+		inventories[i].Clients = clients
+		return nil
+	})
+
+	switch *formatArg {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(inventories); err != nil {
+			log.Fatal(err)
+		}
+	case "csv":
+		writeMatrixCSV(lunash.NewClientMatrix(inventories))
+	case "text":
+		writeMatrixText(lunash.NewClientMatrix(inventories))
+	default:
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	report(results)
+}
+
+func writeMatrixText(matrix *lunash.ClientMatrix) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "CLIENT\tHOST\t%s\n", strings.Join(matrix.Partitions, "\t"))
+
+	for _, row := range matrix.Rows {
+		fmt.Fprintf(w, "%s\t%s", row.Client, clientHost(row))
+		for _, access := range row.Access {
+			if access {
+				fmt.Fprint(w, "\tx")
+			} else {
+				fmt.Fprint(w, "\t-")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	w.Flush()
+}
+
+func writeMatrixCSV(matrix *lunash.ClientMatrix) {
+	w := csv.NewWriter(os.Stdout)
+	w.Write(append([]string{"client", "host"}, matrix.Partitions...))
+
+	for _, row := range matrix.Rows {
+		record := []string{row.Client, clientHost(row)}
+		for _, access := range row.Access {
+			if access {
+				record = append(record, "yes")
+			} else {
+				record = append(record, "no")
+			}
+		}
+		w.Write(record)
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// clientHost returns a client's hostname and IP, whichever are set.
+func clientHost(row lunash.ClientMatrixRow) string {
+	switch {
+	case row.Hostname != "" && row.IP != "":
+		return fmt.Sprintf("%s (%s)", row.Hostname, row.IP)
+	case row.Hostname != "":
+		return row.Hostname
+	}
+	return row.IP
+}
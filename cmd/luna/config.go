@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mastahyeti/lunash"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+var configCommands = map[string]command{
+	"encrypt":  configEncrypt,
+	"decrypt":  configDecrypt,
+	"edit":     configEdit,
+	"validate": configValidate,
+}
+
+func configCommand(args []string) {
+	dispatch("luna config", configCommands, args)
+}
+
+// configEncrypt encrypts a plaintext config file in place.
+func configEncrypt(args []string) {
+	flags := flag.NewFlagSet("luna config encrypt", flag.ExitOnError)
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	outArg := flags.String("out", "", "where to write the encrypted config (defaults to -config)")
+	recipientsArg := flags.String("recipients", "", "PGP keyring of recipients to encrypt to, instead of using a passphrase")
+	flags.Parse(args)
+
+	confPath, err := lunash.FindConfig(*confArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	plain, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Error reading config file"))
+	}
+
+	if lunash.ConfigEncryption(plain) != lunash.EncryptionNone {
+		log.Fatalf("%s is already encrypted", confPath)
+	}
+
+	method := lunash.EncryptionPassphrase
+	var recipients openpgp.EntityList
+	if *recipientsArg != "" {
+		method = lunash.EncryptionPGP
+		if recipients, err = lunash.LoadKeyring(*recipientsArg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	enc, err := encryptConfig(plain, method, recipients)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := *outArg
+	if out == "" {
+		out = confPath
+	}
+
+	if err = writePrivate(out, enc); err != nil {
+		log.Fatal(errors.Wrap(err, "Error writing config file"))
+	}
+}
+
+// configDecrypt writes the decrypted contents of a config file to stdout or to
+// a file.
+func configDecrypt(args []string) {
+	flags := flag.NewFlagSet("luna config decrypt", flag.ExitOnError)
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	outArg := flags.String("out", "", "where to write the decrypted config (defaults to stdout)")
+	flags.Parse(args)
+
+	confPath, err := lunash.FindConfig(*confArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Error reading config file"))
+	}
+
+	plain, err := lunash.DecryptConfig(enc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *outArg == "" {
+		os.Stdout.Write(plain)
+		return
+	}
+
+	if err = writePrivate(*outArg, plain); err != nil {
+		log.Fatal(errors.Wrap(err, "Error writing config file"))
+	}
+}
+
+// configEdit decrypts a config file into a private temporary file, opens it in
+// $EDITOR and encrypts the result the same way the original was encrypted.
+func configEdit(args []string) {
+	flags := flag.NewFlagSet("luna config edit", flag.ExitOnError)
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	confPath, err := lunash.FindConfig(*confArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Error reading config file"))
+	}
+
+	method := lunash.ConfigEncryption(enc)
+	if method == lunash.EncryptionNone {
+		log.Fatalf("%s isn't encrypted", confPath)
+	}
+
+	// Remember the passphrase so we reuse it when re-encrypting.
+	var passphrase []byte
+	prompt := lunash.PassphrasePrompt
+	lunash.PassphrasePrompt = func(msg string) ([]byte, error) {
+		if passphrase == nil {
+			p, err := prompt(msg)
+			if err != nil {
+				return nil, err
+			}
+			passphrase = p
+		}
+		return passphrase, nil
+	}
+
+	var recipients openpgp.EntityList
+	if method == lunash.EncryptionPGP {
+		keyring, err := lunash.LoadKeyring(os.Getenv(lunash.KeyringEnv))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if recipients, err = lunash.ConfigRecipients(enc, keyring); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	plain, err := lunash.DecryptConfig(enc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	edited, err := editInEditor(plain, filepath.Ext(confPath))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if bytes.Equal(plain, edited) {
+		return
+	}
+
+	if enc, err = encryptConfig(edited, method, recipients); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = writePrivate(confPath, enc); err != nil {
+		log.Fatal(errors.Wrap(err, "Error writing config file"))
+	}
+}
+
+// configValidate strictly loads a config file, reporting every problem found.
+func configValidate(args []string) {
+	flags := flag.NewFlagSet("luna config validate", flag.ExitOnError)
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	configs, err := lunash.LoadAllConfigsStrict(*confArg)
+	if problems, ok := err.(lunash.ConfigErrors); ok {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("OK: %d HSMs\n", len(configs))
+}
+
+func encryptConfig(plain []byte, method string, recipients openpgp.EntityList) ([]byte, error) {
+	if method == lunash.EncryptionPGP {
+		return lunash.EncryptConfigTo(plain, recipients)
+	}
+
+	passphrase, err := lunash.PassphrasePrompt("New config passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	confirm, err := lunash.PassphrasePrompt("Confirm config passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(passphrase, confirm) {
+		return nil, errors.New("Passphrases don't match")
+	}
+
+	return lunash.EncryptConfig(plain, passphrase)
+}
+
+// editInEditor lets the user edit data in $EDITOR. The temporary file is given
+// the extension ext so the editor can detect the format.
+func editInEditor(data []byte, ext string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "lunash")
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lunash"+ext)
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, errors.Wrap(err, "Error writing temporary file")
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// $EDITOR may include arguments, eg. "code --wait".
+	argv := append(strings.Fields(editor), path)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return nil, errors.Wrap(err, "Error running editor")
+	}
+
+	edited, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading temporary file")
+	}
+
+	return edited, nil
+}
+
+// writePrivate replaces a file with data that only the current user can read.
+// The file is written atomically, so a failed write can't leave a config file
+// truncated.
+func writePrivate(path string, data []byte) error {
+	return lunash.WriteFileAtomic(path, data, 0600)
+}
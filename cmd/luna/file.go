@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mastahyeti/lunash"
+)
+
+var fileCommands = map[string]command{
+	"list":   fileList,
+	"delete": fileDelete,
+}
+
+func fileCommand(args []string) {
+	dispatch("luna file", fileCommands, args)
+}
+
+// fileList lists the files in an HSM's file area.
+func fileList(args []string) {
+	flags := flag.NewFlagSet("luna file list", flag.ExitOnError)
+	nameArg := flags.String("name", "", "name of HSM to list files on")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	client := connect(flags, *confArg, *nameArg)
+	defer client.Close()
+
+	files, err := client.ListFiles()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, file := range files {
+		fmt.Printf("%12d  %s  %s\n", file.Size, file.Date.Format("2006-01-02 15:04"), file.Name)
+	}
+}
+
+// fileDelete deletes the named files from an HSM's file area.
+func fileDelete(args []string) {
+	flags := flag.NewFlagSet("luna file delete", flag.ExitOnError)
+	nameArg := flags.String("name", "", "name of HSM to delete files from")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	client := connect(flags, *confArg, *nameArg)
+	defer client.Close()
+
+	for _, name := range flags.Args() {
+		if err := client.DeleteFile(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// connect connects to the named HSM.
+func connect(flags *flag.FlagSet, confPath, name string) *lunash.Client {
+	if name == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	config, err := lunash.LoadConfig(confPath, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := config.Client()
+	if err = client.Connect(); err != nil {
+		log.Fatal(err)
+	}
+
+	return client
+}
+
+// loadConfigs loads the named HSMs, or all of them.
+func loadConfigs(flags *flag.FlagSet, confPath, names string, all bool) []*lunash.Config {
+	var configs []*lunash.Config
+	var err error
+
+	switch {
+	case all:
+		configs, err = lunash.LoadAllConfigs(confPath)
+	case names != "":
+		configs, err = lunash.LoadConfigs(confPath, strings.Split(names, ","))
+	default:
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return configs
+}
+
+// report logs each HSM's result and exits if any failed.
+func report(results []lunash.Result) {
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("host=%s error='%s'", result.Config.Hostname, result.Err.Error())
+		}
+	}
+
+	if len(lunash.Failed(results)) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a luna subcommand. It's passed the arguments following its name.
+type command func(args []string)
+
+var commands = map[string]command{
+	"cert":      certCommand,
+	"chrystoki": chrystokiCommand,
+	"client":    clientCommand,
+	"config":    configCommand,
+	"file":      fileCommand,
+	"policy":    policyCommand,
+	"store":     storeCommand,
+
+	"rotate-ntls-cert": rotateNTLSCert,
+}
+
+func main() {
+	dispatch("luna", commands, os.Args[1:])
+}
+
+// dispatch runs the command named by the first argument.
+func dispatch(prefix string, cmds map[string]command, args []string) {
+	if len(args) < 1 {
+		usage(prefix, cmds)
+		os.Exit(1)
+	}
+
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		usage(prefix, cmds)
+		os.Exit(1)
+	}
+
+	cmd(args[1:])
+}
+
+func usage(prefix string, cmds map[string]command) {
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s <%s> [flags]\n", prefix, strings.Join(names, "|"))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/mastahyeti/lunash"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+var policyCommands = map[string]command{
+	"show":  policyShow,
+	"diff":  policyDiff,
+	"apply": policyApply,
+}
+
+func policyCommand(args []string) {
+	dispatch("luna policy", policyCommands, args)
+}
+
+// policyFlags holds the flags shared by policy commands.
+type policyFlags struct {
+	*flag.FlagSet
+	name      *string
+	partition *string
+	conf      *string
+	file      *string
+}
+
+func newPolicyFlags(name string, desired bool) *policyFlags {
+	flags := &policyFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError)}
+	flags.name = flags.String("name", "", "name of HSM")
+	flags.partition = flags.String("partition", "", "partition whose policies to use, instead of the HSM's")
+	flags.conf = flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	if desired {
+		flags.file = flags.String("f", "", "YAML or JSON file mapping policy codes or descriptions to their desired values")
+	}
+	return flags
+}
+
+// policies connects to the HSM and reads the HSM or partition policies.
+func (flags *policyFlags) policies() (*lunash.Client, []lunash.Policy) {
+	client := connect(flags.FlagSet, *flags.conf, *flags.name)
+
+	var policies []lunash.Policy
+	var err error
+	if *flags.partition != "" {
+		policies, err = client.PartitionPolicies(*flags.partition)
+	} else {
+		policies, err = client.HSMPolicies()
+	}
+	if err != nil {
+		client.Close()
+		log.Fatal(err)
+	}
+
+	return client, policies
+}
+
+// changes connects to the HSM and returns the changes needed to apply the
+// desired policies.
+func (flags *policyFlags) changes() (*lunash.Client, []lunash.PolicyChange) {
+	if *flags.file == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	data, err := ioutil.ReadFile(*flags.file)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Error reading desired policies"))
+	}
+
+	var desired map[string]string
+	if err = yaml.Unmarshal(data, &desired); err != nil {
+		log.Fatal(errors.Wrap(err, "Error parsing desired policies"))
+	}
+
+	client, policies := flags.policies()
+
+	changes, err := lunash.DiffPolicies(policies, desired)
+	if err != nil {
+		client.Close()
+		log.Fatal(err)
+	}
+
+	return client, changes
+}
+
+// policyShow lists the HSM or partition policies.
+func policyShow(args []string) {
+	flags := newPolicyFlags("luna policy show", false)
+	flags.Parse(args)
+
+	client, policies := flags.policies()
+	defer client.Close()
+
+	for _, policy := range policies {
+		destructive := ""
+		if policy.Destructive {
+			destructive = "destructive"
+		}
+		fmt.Printf("%4d  %-12s %-12s %s\n", policy.Code, policy.Value, destructive, policy.Description)
+	}
+}
+
+// policyDiff lists the changes needed to apply the desired policies.
+func policyDiff(args []string) {
+	flags := newPolicyFlags("luna policy diff", true)
+	flags.Parse(args)
+
+	client, changes := flags.changes()
+	defer client.Close()
+
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+}
+
+// policyApply changes the policies that differ from the desired policies.
+func policyApply(args []string) {
+	flags := newPolicyFlags("luna policy apply", true)
+	destructiveArg := flags.Bool("destructive", false, "allow changing destructive policies, which ZEROIZES the HSM or partition")
+	flags.Parse(args)
+
+	client, changes := flags.changes()
+	defer client.Close()
+
+	for _, change := range changes {
+		log.Printf("Changing %s", change)
+	}
+
+	var err error
+	if *flags.partition != "" {
+		err = client.ApplyPartitionPolicies(*flags.partition, changes, *destructiveArg)
+	} else {
+		err = client.ApplyHSMPolicies(changes, *destructiveArg)
+	}
+	if err != nil {
+		client.Close()
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mastahyeti/lunash"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// rotateNTLSCert regenerates an HSM's NTLS certificate, saves the old and
+// new certificates and writes a bundle for each registered client.
+func rotateNTLSCert(args []string) {
+	flags := flag.NewFlagSet("luna rotate-ntls-cert", flag.ExitOnError)
+	nameArg := flags.String("name", "", "name of HSM whose NTLS certificate to rotate")
+	deviceArg := flags.String("device", "all", "network device to bind NTLS to")
+	outArg := flags.String("out", "", "directory to save certificates and client bundles in (defaults to ntls-rotation-<name>-<time>)")
+	yesArg := flags.Bool("yes", false, "don't ask for confirmation")
+	servedArg := flags.Bool("verify-served", true, "check that NTLS serves the new certificate afterwards")
+	confArg := flags.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	flags.Parse(args)
+
+	client := connect(flags, *confArg, *nameArg)
+	defer client.Close()
+
+	fatal := func(err error) {
+		client.Close()
+		log.Fatal(err)
+	}
+
+	_, cert, err := client.NTLSCert()
+	if err != nil {
+		fatal(err)
+	}
+
+	clients, err := client.Clients()
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Current NTLS certificate for %s expires %s\n", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02"))
+	fmt.Fprintf(os.Stderr, "  SHA-256 %s\n", lunash.CertFingerprint(cert))
+	fmt.Fprintf(os.Stderr, "%d registered clients will stop trusting the HSM until they're given the new certificate.\n", len(clients))
+
+	out := *outArg
+	if out == "" {
+		out = fmt.Sprintf("ntls-rotation-%s-%s", *nameArg, time.Now().Format("20060102-150405"))
+	}
+
+	// Once the certificate is rotated, the bundles have to be saved.
+	if err = checkWritableDir(out); err != nil {
+		fatal(err)
+	}
+
+	if !*yesArg && !confirm(*nameArg) {
+		client.Close()
+		log.Fatal("Not confirmed")
+	}
+
+	rotation, err := client.RotateNTLSCert(*deviceArg)
+	if rotation != nil && rotation.NewPEM != nil {
+		if werr := rotation.WriteBundle(out, clients); werr != nil {
+			// Clients need the new certificate, so show it rather than
+			// only reporting the error.
+			log.Printf("Old certificate:\n%s", rotation.OldPEM)
+			log.Printf("New certificate:\n%s", rotation.NewPEM)
+			fatal(errors.Wrap(werr, "NTLS certificate was rotated, but the client bundles weren't saved"))
+		} else {
+			log.Printf("Saved certificates and client bundles in %s", out)
+		}
+	} else if rotation != nil {
+		log.Printf("Old certificate:\n%s", rotation.OldPEM)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	log.Printf("New NTLS certificate expires %s", rotation.New.NotAfter.Format("2006-01-02"))
+	log.Printf("  SHA-256 %s", lunash.CertFingerprint(rotation.New))
+
+	if *servedArg {
+		if err = verifyServed(rotation); err != nil {
+			fatal(err)
+		}
+		log.Printf("NTLS is serving the new certificate")
+	}
+}
+
+// checkWritableDir creates dir if needed and checks that files can be written
+// in it.
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "Error creating output directory")
+	}
+
+	f, err := ioutil.TempFile(dir, ".check")
+	if err != nil {
+		return errors.Wrap(err, "Error writing to output directory")
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// confirm asks the user to type the HSM's name to continue.
+func confirm(name string) bool {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		log.Fatal("Refusing to continue without confirmation; use -yes")
+	}
+
+	fmt.Fprintf(os.Stderr, "Type the HSM's name (%s) to continue: ", name)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(line) == name
+}
+
+// verifyServed waits for NTLS to restart and serve the new certificate.
+func verifyServed(rotation *lunash.NTLSRotation) error {
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = rotation.VerifyServed(5 * time.Second); err == nil {
+			return nil
+		}
+		time.Sleep(3 * time.Second)
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mastahyeti/lunash"
+)
+
+var storeCommands = map[string]command{
+	"list":    storeList,
+	"changes": storeChanges,
+	"diff":    storeDiff,
+	"cat":     storeCat,
+}
+
+func storeCommand(args []string) {
+	dispatch("luna store", storeCommands, args)
+}
+
+// storeFlags returns a flag set with the flags shared by store commands.
+func storeFlags(name string) (*flag.FlagSet, *string, *string, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	dirArg := flags.String("store", "", "path to the artifact store (defaults to $LUNASH_STORE or ~/.local/share/lunash/store)")
+	hostArg := flags.String("host", "", "only show files from this HSM")
+	pathArg := flags.String("path", "", "only show files with this path")
+	return flags, dirArg, hostArg, pathArg
+}
+
+func openStore(dir string) *lunash.ArtifactStore {
+	store, err := lunash.OpenArtifactStore(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return store
+}
+
+// storeList lists every version of the stored files.
+func storeList(args []string) {
+	flags, dirArg, hostArg, pathArg := storeFlags("luna store list")
+	flags.Parse(args)
+
+	versions, err := openStore(*dirArg).Versions(*hostArg, *pathArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	printArtifacts(versions)
+}
+
+// storeChanges lists the versions of stored files whose contents changed.
+func storeChanges(args []string) {
+	flags, dirArg, hostArg, pathArg := storeFlags("luna store changes")
+	flags.Parse(args)
+
+	changes, err := openStore(*dirArg).Changes(*hostArg, *pathArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	printArtifacts(changes)
+}
+
+// storeDiff diffs two versions, given by digest, or the last two versions of a
+// file on an HSM.
+func storeDiff(args []string) {
+	flags, dirArg, hostArg, pathArg := storeFlags("luna store diff")
+	flags.Parse(args)
+
+	store := openStore(*dirArg)
+
+	var a, b *lunash.Artifact
+	var err error
+
+	switch {
+	case flags.NArg() == 2:
+		if a, err = store.Find(flags.Arg(0)); err != nil {
+			log.Fatal(err)
+		}
+		if b, err = store.Find(flags.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+	case flags.NArg() == 0 && *hostArg != "" && *pathArg != "":
+		versions, err := store.Versions(*hostArg, *pathArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(versions) < 2 {
+			log.Fatalf("Fewer than two versions of %s from %s", *pathArg, *hostArg)
+		}
+		a, b = &versions[len(versions)-2], &versions[len(versions)-1]
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: luna store diff [-host HOST -path PATH | DIGEST DIGEST]")
+		os.Exit(1)
+	}
+
+	diff, err := store.Diff(a, b)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Print(diff)
+}
+
+// storeCat writes the contents of a version, given by digest, to stdout.
+func storeCat(args []string) {
+	flags, dirArg, _, _ := storeFlags("luna store cat")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: luna store cat DIGEST")
+		os.Exit(1)
+	}
+
+	store := openStore(*dirArg)
+
+	artifact, err := store.Find(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := store.Read(artifact)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Stdout.Write(data)
+}
+
+func printArtifacts(artifacts []lunash.Artifact) {
+	for _, a := range artifacts {
+		fmt.Printf("%s  %-20s  %-24s  %10d  %s\n", a.Fetched.Local().Format(time.RFC3339), a.Host, a.Path, a.Size, a.Digest[:19])
+	}
+}
@@ -1,49 +1,100 @@
 package main
 
 import (
+	"archive/tar"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/mastahyeti/lunash"
 	"github.com/mastahyeti/lunash/scp"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
-	pathArg  = flag.String("path", "", "path of file to get from HSM")
-	nameArg  = flag.String("name", "", "name of HSM to get file from")
-	confArg  = flag.String("config", "./lunash.json", "path to the config file")
-	debugArg = flag.Bool("debug", false, "whether to output debugging information")
+	pathArg     = flag.String("path", "", "path of file to get from HSM")
+	dirArg      = flag.String("dir", "", "local directory to write files into, instead of stdout")
+	tarArg      = flag.Bool("tar", false, "write a tar stream of the files, in a directory per HSM, to stdout")
+	storeArg    = flag.Bool("store", false, "record the files as new versions in the artifact store at $LUNASH_STORE or ~/.local/share/lunash/store, instead of writing them out")
+	rArg        = flag.Bool("r", false, "whether to recursively copy directories")
+	pArg        = flag.Bool("p", false, "whether to preserve modes and modification and access times")
+	nameArg     = flag.String("name", "", "name of HSM to get file from")
+	namesArg    = flag.String("names", "", "comma separated list of HSMs to get files from")
+	allArg      = flag.Bool("all", false, "get files from all HSMs in the config file")
+	parallelArg = flag.Int("parallel", 10, "how many HSMs to get files from at once")
+	confArg     = flag.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	debugArg    = flag.Bool("debug", false, "whether to output debugging information")
 
-	path     string
-	name     string
+	paths    []string
+	dir      string
+	all      bool
+	names    []string
 	confPath string
 )
 
 func parseFlags() {
 	flag.Parse()
 
+	// Additional paths may follow the flags.
 	if pathArg != nil && len(*pathArg) > 0 {
-		path = *pathArg
-	} else {
+		paths = append(paths, *pathArg)
+	}
+	paths = append(paths, flag.Args()...)
+
+	if len(paths) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if nameArg != nil && len(*nameArg) > 0 {
-		name = *nameArg
+	if dirArg != nil {
+		dir = *dirArg
+	}
+
+	if allArg != nil && *allArg {
+		all = true
+	} else if namesArg != nil && len(*namesArg) > 0 {
+		names = strings.Split(*namesArg, ",")
+	} else if nameArg != nil && len(*nameArg) > 0 {
+		names = []string{*nameArg}
 	} else {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if confArg != nil && len(*confArg) > 0 {
-		confPath = *confArg
-	} else {
+	outputs := 0
+	for _, set := range []bool{dir != "", *tarArg, *storeArg} {
+		if set {
+			outputs++
+		}
+	}
+	if outputs > 1 {
+		fmt.Fprintln(os.Stderr, "Only one of -dir, -tar and -store can be used")
+		os.Exit(1)
+	}
+
+	if *storeArg && (*rArg || strings.ContainsAny(strings.Join(paths, ""), "*?[")) {
+		fmt.Fprintln(os.Stderr, "-store can't be used with -r or glob patterns")
+		os.Exit(1)
+	}
+
+	// Only a single file from a single HSM can be written to stdout.
+	multiple := all || len(names) > 1 || len(paths) > 1 || *rArg || strings.ContainsAny(paths[0], "*?[")
+	if outputs == 0 && multiple {
+		fmt.Fprintln(os.Stderr, "-dir, -tar or -store is required when getting multiple files")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if confArg != nil {
+		confPath = *confArg
+	}
+
 	if debugArg != nil && *debugArg {
 		scp.Debug = true
 	}
@@ -52,21 +103,180 @@ func parseFlags() {
 func main() {
 	parseFlags()
 
-	config, err := lunash.LoadConfig(confPath, name)
+	var configs []*lunash.Config
+	var err error
+
+	if all {
+		configs, err = lunash.LoadAllConfigs(confPath)
+	} else if len(names) == 1 {
+		var config *lunash.Config
+		config, err = lunash.LoadConfig(confPath, names[0])
+		configs = []*lunash.Config{config}
+	} else {
+		configs, err = lunash.LoadConfigs(confPath, names)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	switch {
+	case *storeArg:
+		getToStore(configs)
+	case !all && len(names) == 1 && !*tarArg:
+		getOne(configs[0])
+	default:
+		getMany(configs)
+	}
+}
+
+// getToStore records the files from each HSM as new versions in the artifact
+// store, logging those that changed.
+func getToStore(configs []*lunash.Config) {
+	store, err := lunash.OpenArtifactStore("")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	results := lunash.ForEach(configs, *parallelArg, func(config *lunash.Config, client *lunash.Client) error {
+		for _, path := range paths {
+			artifact, changed, err := store.Fetch(client, path)
+			if err != nil {
+				return err
+			}
+
+			if changed {
+				log.Printf("host=%s path=%s changed digest=%s", config.Hostname, path, artifact.Digest)
+			}
+		}
+		return nil
+	})
+
+	report(results)
+}
+
+// getOne gets files from a single HSM, into -dir or to stdout.
+func getOne(config *lunash.Config) {
 	client := config.Client()
-	if err = client.Connect(); err != nil {
+	if err := client.Connect(); err != nil {
 		log.Fatal(err)
 	}
 	defer client.Close()
 
-	file, err := client.ScpGet(path)
+	// Only draw progress bars for people.
+	var progress scp.ProgressFunc
+	if terminal.IsTerminal(int(os.Stderr.Fd())) {
+		progress = scp.ProgressBar(os.Stderr)
+	}
+
+	var err error
+	if dir != "" {
+		err = client.ScpGetFiles(paths, dir, scp.Options{Recursive: *rArg, Preserve: *pArg, Progress: progress})
+	} else {
+		_, err = client.ScpGetWithProgress(paths[0], os.Stdout, progress)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+// getMany gets files from each HSM concurrently into <dir>/<nickname>, or
+// into a temporary directory that's written to stdout as a tar stream.
+func getMany(configs []*lunash.Config) {
+	out := dir
+	if *tarArg {
+		tmp, err := ioutil.TempDir("", "lunascp-get")
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Error creating temporary directory"))
+		}
+		defer os.RemoveAll(tmp)
+		out = tmp
+	}
+
+	opts := scp.Options{Recursive: *rArg, Preserve: *pArg}
+
+	results := lunash.ForEach(configs, *parallelArg, func(config *lunash.Config, client *lunash.Client) error {
+		hostDir := filepath.Join(out, config.Name())
+		if err := os.MkdirAll(hostDir, 0755); err != nil {
+			return errors.Wrap(err, "Error creating directory")
+		}
+		return client.ScpGetFiles(paths, hostDir, opts)
+	})
+
+	if *tarArg {
+		if err := writeTar(os.Stdout, out, results); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	report(results)
+}
+
+// report logs the result for each HSM, exiting unsuccessfully if any failed.
+func report(results []lunash.Result) {
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("host=%s error='%s'", result.Config.Hostname, result.Err.Error())
+		} else {
+			log.Printf("host=%s ok duration=%s", result.Config.Hostname, result.Duration)
+		}
+	}
+
+	if len(lunash.Failed(results)) > 0 {
+		os.Exit(1)
+	}
+}
+
+// writeTar writes the files collected from each successful HSM as a tar
+// stream, with paths beginning with the HSM's name.
+func writeTar(w io.Writer, dir string, results []lunash.Result) error {
+	tw := tar.NewWriter(w)
+
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+
+		root := filepath.Join(dir, result.Config.Name())
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+
+			if err = tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			_, err = io.Copy(tw, file)
+			return err
+		})
+		if err != nil {
+			return errors.Wrap(err, "Error writing tar stream")
+		}
+	}
 
-	os.Stdout.Write(file)
+	return errors.Wrap(tw.Close(), "Error writing tar stream")
 }
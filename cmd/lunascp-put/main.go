@@ -1,52 +1,107 @@
 package main
 
 import (
-	"bytes"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/mastahyeti/lunash"
 	"github.com/mastahyeti/lunash/scp"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
-	pathArg  = flag.String("path", "", "where to put the file on the HSM")
-	nameArg  = flag.String("name", "", "name of HSM to put file on")
-	confArg  = flag.String("config", "./lunash.json", "path to the config file")
-	debugArg = flag.Bool("debug", false, "whether to output debugging information")
+	pathArg        = flag.String("path", "", "where to put the file from stdin on the HSM")
+	dirArg         = flag.String("dir", ".", "directory on the HSM to put files named as arguments in")
+	rArg           = flag.Bool("r", false, "whether to recursively copy directories")
+	verifyArg      = flag.Bool("verify", false, "whether to check the sizes of uploaded files against the HSM's file listing (contents aren't compared)")
+	noOverwriteArg = flag.Bool("no-overwrite", false, "whether to refuse to overwrite files already on the HSM")
+	cleanupArg     = flag.Bool("cleanup", false, "whether to delete uploaded files from the HSM if the upload or verification fails")
+	modeArg        = flag.String("mode", "0644", "mode of the file from stdin on the HSM")
+	pArg           = flag.Bool("p", false, "whether to preserve modes and modification and access times")
+	nameArg        = flag.String("name", "", "name of HSM to put file on")
+	namesArg       = flag.String("names", "", "comma separated list of HSMs to put files on")
+	allArg         = flag.Bool("all", false, "put files on all HSMs in the config file")
+	parallelArg    = flag.Int("parallel", 10, "how many HSMs to put files on at once")
+	confArg        = flag.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
+	debugArg       = flag.Bool("debug", false, "whether to output debugging information")
 
 	path     string
-	name     string
+	files    []string
+	dir      string
+	mode     os.FileMode
+	all      bool
+	names    []string
 	confPath string
+
+	// stdin is read from stdinOffset by each HSM.
+	stdin       *os.File
+	stdinOffset int64
+	stdinInfo   *scp.FileInfo
 )
 
 func parseFlags() {
 	flag.Parse()
 
+	// Local files to upload may follow the flags. Otherwise, stdin is
+	// uploaded to -path.
+	for _, pattern := range flag.Args() {
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			fmt.Fprintf(os.Stderr, "No files match %s\n", pattern)
+			os.Exit(1)
+		}
+		files = append(files, matches...)
+	}
+
 	if pathArg != nil && len(*pathArg) > 0 {
 		path = *pathArg
-	} else {
+	} else if len(files) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if nameArg != nil && len(*nameArg) > 0 {
-		name = *nameArg
+	if dirArg != nil {
+		dir = *dirArg
+	}
+
+	// "my file list" only shows the top level of the file area, so that's
+	// the only place uploads can be checked.
+	topLevel := !*rArg && filepath.Clean(dir) == "." && filepath.Dir(path) == "."
+	if (*verifyArg || *noOverwriteArg || *cleanupArg) && !topLevel {
+		fmt.Fprintln(os.Stderr, "-verify, -no-overwrite and -cleanup only work for files put in the top level of the file area, without -r or -dir")
+		os.Exit(1)
+	}
+
+	if m, err := strconv.ParseUint(*modeArg, 8, 32); err == nil {
+		mode = os.FileMode(m).Perm()
 	} else {
-		flag.Usage()
+		fmt.Fprintf(os.Stderr, "Bad mode %s\n", *modeArg)
 		os.Exit(1)
 	}
 
-	if confArg != nil && len(*confArg) > 0 {
-		confPath = *confArg
+	if allArg != nil && *allArg {
+		all = true
+	} else if namesArg != nil && len(*namesArg) > 0 {
+		names = strings.Split(*namesArg, ",")
+	} else if nameArg != nil && len(*nameArg) > 0 {
+		names = []string{*nameArg}
 	} else {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if confArg != nil {
+		confPath = *confArg
+	}
+
 	if debugArg != nil && *debugArg {
 		scp.Debug = true
 	}
@@ -55,23 +110,183 @@ func parseFlags() {
 func main() {
 	parseFlags()
 
-	config, err := lunash.LoadConfig(confPath, name)
+	var configs []*lunash.Config
+	var err error
+
+	if all {
+		configs, err = lunash.LoadAllConfigs(confPath)
+	} else if len(names) == 1 {
+		var config *lunash.Config
+		config, err = lunash.LoadConfig(confPath, names[0])
+		configs = []*lunash.Config{config}
+	} else {
+		configs, err = lunash.LoadConfigs(confPath, names)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	client := config.Client()
-	if err = client.Connect(); err != nil {
-		log.Fatal(err)
+	// The sizes of the files being uploaded. Flags checking them are only
+	// allowed for uploads to the top level of the file area.
+	sizes := make(map[string]int64)
+
+	if len(files) > 0 {
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+				sizes[filepath.Base(file)] = info.Size()
+			}
+		}
+	} else {
+		if stdin, stdinInfo, err = sizedStdin(); err != nil {
+			log.Fatal(err)
+		}
+		defer stdin.Close()
+
+		if stdinOffset, err = stdin.Seek(0, io.SeekCurrent); err != nil {
+			log.Fatal(errors.Wrap(err, "Error reading file from stdin"))
+		}
+
+		sizes[filepath.Base(path)] = stdinInfo.Size
+	}
+
+	if len(configs) == 1 && !all {
+		client := configs[0].Client()
+		if err = client.Connect(); err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+
+		// Only draw progress bars for people.
+		var progress scp.ProgressFunc
+		if terminal.IsTerminal(int(os.Stderr.Fd())) {
+			progress = scp.ProgressBar(os.Stderr)
+		}
+
+		if err = put(client, sizes, progress); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	defer client.Close()
 
-	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, os.Stdin); err != nil {
-		log.Fatal(errors.Wrap(err, "Error reading file from stdin"))
+	results := lunash.ForEach(configs, *parallelArg, func(config *lunash.Config, client *lunash.Client) error {
+		return put(client, sizes, nil)
+	})
+
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("host=%s error='%s'", result.Config.Hostname, result.Err.Error())
+		} else {
+			log.Printf("host=%s ok duration=%s", result.Config.Hostname, result.Duration)
+		}
 	}
 
-	if err := client.ScpPut(path, buf.Bytes()); err != nil {
-		log.Fatal(err)
+	if len(lunash.Failed(results)) > 0 {
+		os.Exit(1)
 	}
 }
+
+// put uploads the files, or stdin, to one HSM. sizes are the sizes of the
+// files being uploaded to the top level of the file area.
+func put(client *lunash.Client, sizes map[string]int64, progress scp.ProgressFunc) error {
+	// Files already on the HSM, which cleanup mustn't delete.
+	existing := make(map[string]bool)
+
+	if *noOverwriteArg || *cleanupArg {
+		listed, err := client.ListFiles()
+		if err != nil {
+			return err
+		}
+
+		for _, file := range listed {
+			if _, uploading := sizes[file.Name]; !uploading {
+				continue
+			}
+			if *noOverwriteArg {
+				return fmt.Errorf("%s already exists on the HSM", file.Name)
+			}
+			existing[file.Name] = true
+		}
+	}
+
+	var err error
+
+	if len(files) > 0 {
+		opts := scp.Options{Recursive: *rArg, Preserve: *pArg, Progress: progress}
+		err = client.ScpPutFiles(files, dir, opts)
+	} else {
+		// Each HSM reads stdin from the start.
+		var r io.Reader = io.NewSectionReader(stdin, stdinOffset, stdinInfo.Size)
+		if progress != nil {
+			r = scp.NewProgressReader(r, path, stdinInfo.Size, progress)
+		}
+		err = client.ScpPutWithInfo(path, stdinInfo, r)
+	}
+
+	if err == nil && *verifyArg {
+		err = client.VerifyFiles(sizes)
+	}
+
+	if err != nil && *cleanupArg {
+		cleanup(client, sizes, existing)
+	}
+
+	return err
+}
+
+// cleanup deletes files left on the HSM by a failed upload, except for those
+// that were there before it started.
+func cleanup(client *lunash.Client, sizes map[string]int64, existing map[string]bool) {
+	for name := range sizes {
+		if existing[name] {
+			continue
+		}
+		if err := client.DeleteFile(name); err != nil {
+			log.Printf("Error cleaning up %s: %s", name, err)
+		}
+	}
+}
+
+// sizedStdin returns stdin along with its size and mode. SCP needs to know the
+// size of a file before sending it, so if stdin isn't a regular file, it's
+// first copied to a temporary file. With -p, a regular file's mode and times
+// are preserved.
+func sizedStdin() (*os.File, *scp.FileInfo, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error reading file from stdin")
+	}
+
+	if info.Mode().IsRegular() {
+		offset, err := os.Stdin.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Error reading file from stdin")
+		}
+
+		sinfo := &scp.FileInfo{Mode: mode, Size: info.Size() - offset}
+		if *pArg {
+			sinfo.Mode = info.Mode().Perm()
+			sinfo.ModTime = info.ModTime()
+		}
+
+		return os.Stdin, sinfo, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "lunascp-put")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error creating temporary file")
+	}
+	os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, os.Stdin)
+	if err != nil {
+		tmp.Close()
+		return nil, nil, errors.Wrap(err, "Error reading file from stdin")
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, nil, errors.Wrap(err, "Error reading temporary file")
+	}
+
+	return tmp, &scp.FileInfo{Mode: mode, Size: size}, nil
+}
@@ -16,7 +16,7 @@ var (
 	cmdArg   = flag.String("command", "", "a semicolon delimited list of commands to run")
 	namesArg = flag.String("names", "", "comma separated list of HSMs to send command to")
 	allArg   = flag.Bool("all", false, "send commands to all HSMs in the config file")
-	confArg  = flag.String("config", "./lunash.json", "path to the config file")
+	confArg  = flag.String("config", "", "path to the config file (defaults to $LUNASH_CONFIG or a lunash.json in the search path)")
 	debugArg = flag.Bool("debug", false, "whether to output debugging information")
 
 	login    bool
@@ -56,11 +56,8 @@ func parseFlags() {
 		os.Exit(1)
 	}
 
-	if confArg != nil && len(*confArg) > 0 {
+	if confArg != nil {
 		confPath = *confArg
-	} else {
-		flag.Usage()
-		os.Exit(1)
 	}
 
 	if debugArg != nil && *debugArg {
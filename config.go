@@ -1,11 +1,8 @@
 package lunash
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"net"
-	"os"
 
 	"golang.org/x/crypto/ssh"
 
@@ -21,31 +18,37 @@ type Config struct {
 	SSHpassword    string `json:"ssh_password"`
 	SSHfingerprint string `json:"ssh_fingerprint"`
 	Password       string `json:"hsm_password"`
+	Group          string `json:"group,omitempty"`
+
+	// Transfer is how files are transferred: "scp", the default, or "sftp".
+	// If the HSM refuses SFTP, SCP is used instead.
+	Transfer string `json:"transfer,omitempty"`
+
+	// Certs are paths of certificates in the HSM's file area to check for
+	// expiry, besides the NTLS certificate.
+	Certs []string `json:"certs,omitempty"`
 }
 
-// LoadAllConfigs loads all Configs from a config file.
+// LoadAllConfigs loads all Configs from a config file and any files it
+// includes, decrypting them if necessary. If path is empty, the config file is
+// found with FindConfig.
 func LoadAllConfigs(path string) ([]*Config, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error opening config file")
-	}
-
-	buf := bytes.NewBuffer(nil)
-	_, err = buf.ReadFrom(f)
+	path, err := FindConfig(path)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error reading config file")
+		return nil, err
 	}
 
-	var configs []*Config
-	if err = json.Unmarshal(buf.Bytes(), &configs); err != nil {
-		return nil, errors.Wrap(err, "Error parsing config file")
+	loader := newConfigLoader()
+	if err = loader.load(path, nil); err != nil {
+		return nil, err
 	}
 
-	return configs, nil
+	return loader.configs()
 }
 
 // LoadConfigs loads the configs for the HSMs with the given nicknames or
-// hostnames.
+// hostnames. It's an error for a name not to match any HSM. An HSM matched by
+// more than one name, eg. its nickname and hostname, is only returned once.
 func LoadConfigs(path string, names []string) ([]*Config, error) {
 	all, err := LoadAllConfigs(path)
 	if err != nil {
@@ -53,15 +56,29 @@ func LoadConfigs(path string, names []string) ([]*Config, error) {
 	}
 
 	configs := make([]*Config, 0, len(all))
+	matched := make(map[string]bool, len(names))
+	added := make(map[*Config]bool, len(all))
 
 	for _, config := range all {
 		for _, name := range names {
-			if config.Hostname == name || config.Nickname == name {
+			if config.Hostname != name && config.Nickname != name {
+				continue
+			}
+
+			matched[name] = true
+			if !added[config] {
 				configs = append(configs, config)
+				added[config] = true
 			}
 		}
 	}
 
+	for _, name := range names {
+		if !matched[name] {
+			return nil, fmt.Errorf("No config with name %s", name)
+		}
+	}
+
 	return configs, nil
 }
 
@@ -72,11 +89,22 @@ func LoadConfig(path string, name string) (*Config, error) {
 		return nil, err
 	}
 
-	if len(cfgs) != 1 {
+	switch len(cfgs) {
+	case 0:
 		return nil, fmt.Errorf("No config with name %s", name)
+	case 1:
+		return cfgs[0], nil
+	default:
+		return nil, fmt.Errorf("Multiple configs with name %s. Run 'luna config validate' to find duplicates", name)
 	}
+}
 
-	return cfgs[0], nil
+// Name returns the HSM's nickname, or its hostname if it doesn't have one.
+func (cfg *Config) Name() string {
+	if cfg.Nickname != "" {
+		return cfg.Nickname
+	}
+	return cfg.Hostname
 }
 
 // Client returns a Client from this config.
@@ -58,6 +58,16 @@ func TestLoadConfigs(t *testing.T) {
 		assert.Equal(t, "2.2.2.2", configs[0].Hostname)
 	}
 
+	// Names for the same HSM only return it once.
+	names = []string{"hsm1", "1.1.1.1", "hsm1"}
+	configs, err = LoadConfigs(exampleConfigPath, names)
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(configs)) {
+		assert.Equal(t, "hsm1", configs[0].Nickname)
+	}
+
+	_, err = LoadConfigs(exampleConfigPath, []string{"hsm1", "hsm9"})
+	assert.EqualError(t, err, "No config with name hsm9")
+
 	_, err = LoadConfigs("./doesnt_exist.json", names)
 	assert.NotNil(t, err)
 
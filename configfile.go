@@ -0,0 +1,404 @@
+package lunash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigEnv is the environment variable naming the config file to use when
+// none is given explicitly.
+const ConfigEnv = "LUNASH_CONFIG"
+
+// Config file formats.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// configExts maps file extensions to config file formats.
+var configExts = map[string]string{
+	".json": FormatJSON,
+	".yaml": FormatYAML,
+	".yml":  FormatYAML,
+	".toml": FormatTOML,
+}
+
+// ConfigSearchPath is the list of directories searched for a lunash.json,
+// lunash.yaml, lunash.yml or lunash.toml file when no config file is given and
+// $LUNASH_CONFIG isn't set.
+var ConfigSearchPath = defaultSearchPath()
+
+func defaultSearchPath() []string {
+	dirs := []string{"."}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".config", "lunash"))
+	}
+
+	return append(dirs, "/etc/lunash")
+}
+
+// FindConfig returns the path of the config file to use. An explicit path is
+// returned as-is. Otherwise $LUNASH_CONFIG is used, falling back to the first
+// config file found in ConfigSearchPath.
+func FindConfig(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+
+	if env := os.Getenv(ConfigEnv); env != "" {
+		return env, nil
+	}
+
+	for _, dir := range ConfigSearchPath {
+		for _, ext := range []string{".json", ".yaml", ".yml", ".toml"} {
+			candidate := filepath.Join(dir, "lunash"+ext)
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("No config file found. Set %s or create one of lunash.{json,yaml,yml,toml} in %s",
+		ConfigEnv,
+		strings.Join(ConfigSearchPath, ", "),
+	)
+}
+
+// ConfigFormat returns the format of the config file at path, based on its
+// extension. Files without a known extension are assumed to be JSON.
+func ConfigFormat(path string) string {
+	if format, ok := configExts[strings.ToLower(filepath.Ext(path))]; ok {
+		return format
+	}
+	return FormatJSON
+}
+
+// configFile is the contents of a single config file. The legacy format, a
+// bare array of HSMs, is equivalent to a configFile with only HSMs.
+type configFile struct {
+	Defaults  *Config            `json:"defaults"`
+	Groups    map[string]*Config `json:"groups"`
+	HSMs      []*Config          `json:"hsms"`
+	Include   []string           `json:"include"`
+	Inventory []*Inventory       `json:"inventory"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting the legacy array
+// format.
+func (cf *configFile) UnmarshalJSON(data []byte) error {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, &cf.HSMs)
+	}
+
+	// Unknown top-level keys most likely mean this isn't a config file.
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	for key := range keys {
+		switch key {
+		case "defaults", "groups", "hsms", "include", "inventory":
+		default:
+			return fmt.Errorf("Unknown config file key '%s'", key)
+		}
+	}
+
+	// Avoid recursing into this method.
+	type plain configFile
+	return json.Unmarshal(data, (*plain)(cf))
+}
+
+// parseConfigFile parses the contents of a config file in the given format.
+func parseConfigFile(data []byte, format string) (*configFile, error) {
+	var v interface{}
+
+	switch format {
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		if _, err := toml.Decode(string(data), &v); err != nil {
+			return nil, err
+		}
+	}
+
+	// YAML and TOML are converted to JSON so that all formats share one set
+	// of field names.
+	if v != nil {
+		converted, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		data = converted
+	}
+
+	cf := new(configFile)
+	if err := json.Unmarshal(data, cf); err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+// configLoader loads a config file along with any files it includes.
+type configLoader struct {
+	groups  map[string]*Config
+	hsms    []*Config
+	parents []*Config
+	sources []configSource
+	loading map[string]bool
+
+	// HSMs from inventories, which are merged with the static HSMs.
+	inventory        []*Config
+	inventoryParents []*Config
+	inventorySources []configSource
+
+	// The contents and effective defaults of each file loaded.
+	files    map[string]*loadedFile
+	defaults map[string]*Config
+
+	// In strict mode, problems with config files are collected rather than
+	// failing immediately.
+	strict   bool
+	problems ConfigErrors
+	nodes    map[string]*configNode
+}
+
+// loadedFile is a config file as read from disk.
+type loadedFile struct {
+	raw        []byte
+	plain      []byte
+	passphrase []byte
+}
+
+// configSource is where an HSM was defined. For HSMs from an inventory, path
+// is the config file referencing the inventory.
+type configSource struct {
+	path      string
+	index     int
+	inventory string
+}
+
+func newConfigLoader() *configLoader {
+	return &configLoader{
+		groups:   map[string]*Config{},
+		loading:  map[string]bool{},
+		nodes:    map[string]*configNode{},
+		files:    map[string]*loadedFile{},
+		defaults: map[string]*Config{},
+	}
+}
+
+// load loads the config file at path. The file's defaults inherit from the
+// defaults of the file including it.
+func (l *configLoader) load(path string, defaults *Config) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return errors.Wrap(err, "Error resolving config file path")
+	}
+	if l.loading[abs] {
+		return l.fail(path, fmt.Errorf("Config file %s includes itself", path))
+	}
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return l.fail(path, errors.Wrap(err, "Error reading config file"))
+	}
+
+	file := &loadedFile{raw: data}
+	l.files[path] = file
+
+	// Remember the passphrase in case the file needs to be re-encrypted.
+	data, err = decryptConfig(data, func(prompt string) ([]byte, error) {
+		p, err := PassphrasePrompt(prompt)
+		file.passphrase = p
+		return p, err
+	})
+	if err != nil {
+		return err
+	}
+	file.plain = data
+
+	format := ConfigFormat(path)
+
+	if l.strict {
+		if !l.check(path, data) {
+			return nil
+		}
+
+		// Carry on without whatever check reported, to find any other
+		// problems in the file.
+		if data, err = json.Marshal(cleanConfigFile(l.nodes[path])); err != nil {
+			return l.fail(path, errors.Wrap(err, "Error parsing config file "+path))
+		}
+		format = FormatJSON
+	}
+
+	cf, err := parseConfigFile(data, format)
+	if err != nil {
+		if l.strict && len(l.problems) > 0 {
+			// Already reported by check with line numbers.
+			return nil
+		}
+		return l.fail(path, errors.Wrap(err, "Error parsing config file "+path))
+	}
+
+	if cf.Defaults != nil {
+		cf.Defaults.inherit(defaults)
+		defaults = cf.Defaults
+	}
+	l.defaults[path] = defaults
+
+	for name, group := range cf.Groups {
+		if _, dup := l.groups[name]; dup {
+			if err = l.fail(path, fmt.Errorf("Group %s is defined more than once", name)); err != nil {
+				return err
+			}
+		}
+		l.groups[name] = group
+	}
+
+	for i, hsm := range cf.HSMs {
+		l.hsms = append(l.hsms, hsm)
+		l.parents = append(l.parents, defaults)
+		l.sources = append(l.sources, configSource{path: path, index: i})
+	}
+
+	for _, inv := range cf.Inventory {
+		if err = l.loadInventory(path, inv, defaults); err != nil {
+			return err
+		}
+	}
+
+	for _, include := range cf.Include {
+		paths, err := includePaths(filepath.Dir(path), include)
+		if err != nil {
+			if err = l.fail(path, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, p := range paths {
+			if err = l.load(p, defaults); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// fail returns err, or records it as a problem in strict mode.
+func (l *configLoader) fail(path string, err error) error {
+	if !l.strict {
+		return err
+	}
+
+	l.problem(path, 0, "%s", err)
+	return nil
+}
+
+// configs resolves each HSM's group and defaults once all files are loaded. A
+// group set in the defaults applies to HSMs that don't set their own.
+func (l *configLoader) configs() ([]*Config, error) {
+	l.mergeInventory()
+
+	for i, hsm := range l.hsms {
+		name := hsm.Group
+		if name == "" && l.parents[i] != nil {
+			name = l.parents[i].Group
+		}
+
+		if name != "" {
+			group, ok := l.groups[name]
+			if !ok && !l.strict {
+				return nil, fmt.Errorf("HSM %s is in undefined group %s", hsm.Hostname, name)
+			} else if !ok {
+				file, line := l.location(i, "group")
+				l.problem(file, line, "%s is in undefined group %s", hsm.Name(), name)
+			}
+			hsm.inherit(group)
+		}
+		hsm.inherit(l.parents[i])
+	}
+
+	return l.hsms, nil
+}
+
+// includePaths expands an include directive, relative to dir. Directories
+// include every config file they contain and patterns are globbed.
+func includePaths(dir, include string) ([]string, error) {
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(dir, include)
+	}
+
+	matches, err := filepath.Glob(include)
+	if err != nil {
+		return nil, errors.Wrap(err, "Bad include pattern "+include)
+	}
+	if len(matches) == 0 && !strings.ContainsAny(include, "*?[") {
+		return nil, fmt.Errorf("Included config file %s doesn't exist", include)
+	}
+
+	var paths []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading included config file")
+		}
+
+		if !info.IsDir() {
+			paths = append(paths, match)
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(match)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading included config directory")
+		}
+
+		for _, entry := range entries {
+			_, known := configExts[strings.ToLower(filepath.Ext(entry.Name()))]
+			if known && !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				paths = append(paths, filepath.Join(match, entry.Name()))
+			}
+		}
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// inherit sets any of the config's unset fields to the parent's values.
+func (cfg *Config) inherit(parent *Config) {
+	if parent == nil {
+		return
+	}
+
+	dst := reflect.ValueOf(cfg).Elem()
+	src := reflect.ValueOf(parent).Elem()
+
+	for i := 0; i < dst.NumField(); i++ {
+		if f := dst.Field(i); f.CanSet() && f.IsZero() {
+			f.Set(src.Field(i))
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package lunash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAllConfigsYAML(t *testing.T) {
+	expected, err := LoadAllConfigs(exampleConfigPath)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	configs, err := LoadAllConfigs("./example_lunash.yaml")
+	if assert.Nil(t, err) {
+		assert.Equal(t, expected[0], configs[0])
+
+		// The group was applied.
+		expected[1].Group = "lab"
+		assert.Equal(t, expected[1], configs[1])
+	}
+}
+
+func TestLoadAllConfigsIncludes(t *testing.T) {
+	configs, err := LoadAllConfigs("./testdata/lunash.toml")
+	if !assert.Nil(t, err) || !assert.Equal(t, 3, len(configs)) {
+		return
+	}
+
+	assert.Equal(t, "hsm1", configs[0].Nickname)
+	assert.Equal(t, 22, configs[0].SSHport)
+	assert.Equal(t, "admin", configs[0].SSHlogin)
+	assert.Equal(t, "password", configs[0].SSHpassword)
+
+	// Included file's defaults inherit from the including file's.
+	assert.Equal(t, "hsm2", configs[1].Nickname)
+	assert.Equal(t, 2222, configs[1].SSHport)
+	assert.Equal(t, "dc2admin", configs[1].SSHlogin)
+	assert.Equal(t, "password", configs[1].SSHpassword)
+
+	assert.Equal(t, "hsm3", configs[2].Nickname)
+	assert.Equal(t, 22, configs[2].SSHport)
+	assert.Equal(t, "legacy", configs[2].SSHlogin)
+
+	_, err = LoadAllConfigs("./testdata/loop.toml")
+	assert.NotNil(t, err)
+}
+
+func TestLoadAllConfigsDefaultGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lunash")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lunash.yaml")
+	err = ioutil.WriteFile(path, []byte(`
+defaults:
+  group: dc1
+  ssh_login: admin
+groups:
+  dc1:
+    ssh_port: 2222
+    ssh_login: dc1admin
+  dc2:
+    ssh_port: 22
+hsms:
+  - hostname: 1.1.1.1
+  - hostname: 2.2.2.2
+    group: dc2
+`), 0600)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	configs, err := LoadAllConfigs(path)
+	if !assert.Nil(t, err) || !assert.Equal(t, 2, len(configs)) {
+		return
+	}
+
+	// The group from the defaults takes precedence over the defaults.
+	assert.Equal(t, "dc1", configs[0].Group)
+	assert.Equal(t, 2222, configs[0].SSHport)
+	assert.Equal(t, "dc1admin", configs[0].SSHlogin)
+
+	assert.Equal(t, "dc2", configs[1].Group)
+	assert.Equal(t, 22, configs[1].SSHport)
+	assert.Equal(t, "admin", configs[1].SSHlogin)
+}
+
+func TestFindConfig(t *testing.T) {
+	path, err := FindConfig("./explicit.json")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "./explicit.json", path)
+	}
+
+	orig := os.Getenv(ConfigEnv)
+	defer os.Setenv(ConfigEnv, orig)
+
+	os.Setenv(ConfigEnv, "./from_env.json")
+	path, err = FindConfig("")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "./from_env.json", path)
+	}
+
+	os.Setenv(ConfigEnv, "")
+
+	origPath := ConfigSearchPath
+	defer func() { ConfigSearchPath = origPath }()
+
+	ConfigSearchPath = []string{"./doesnt_exist", "./testdata"}
+	path, err = FindConfig("")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "testdata/lunash.toml", path)
+	}
+
+	ConfigSearchPath = []string{"./doesnt_exist"}
+	_, err = FindConfig("")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,617 @@
+package lunash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigSet is a set of HSM configs that can be modified and saved back to
+// the config files they were loaded from. Each HSM is written back to the file
+// that defined it, and only fields that differ from what the HSM inherits from
+// defaults and groups are written. Unknown fields are preserved, as are
+// comments in YAML files. TOML files are re-encoded, losing their comments.
+type ConfigSet struct {
+	path   string
+	loader *configLoader
+	docs   map[string]*configDoc
+	dirty  map[string]bool
+}
+
+// OpenConfigSet loads the config file at path, and any files it includes, for
+// modification. If the file doesn't exist, an empty ConfigSet is returned and
+// the file is created when it's saved.
+func OpenConfigSet(path string) (*ConfigSet, error) {
+	path, err := FindConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := &ConfigSet{
+		path:   path,
+		loader: newConfigLoader(),
+		docs:   map[string]*configDoc{},
+		dirty:  map[string]bool{},
+	}
+
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		return cs, nil
+	}
+
+	if err = cs.loader.load(path, nil); err != nil {
+		return nil, err
+	}
+
+	if _, err = cs.loader.configs(); err != nil {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+// Configs returns copies of the HSM configs in the set.
+func (cs *ConfigSet) Configs() []*Config {
+	configs := make([]*Config, 0, len(cs.loader.hsms))
+	for _, cfg := range cs.loader.hsms {
+		c := *cfg
+		configs = append(configs, &c)
+	}
+	return configs
+}
+
+// Lookup returns a copy of the config for the HSM with the given nickname or
+// hostname.
+func (cs *ConfigSet) Lookup(name string) (*Config, error) {
+	i, err := cs.find(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := *cs.loader.hsms[i]
+	return &cfg, nil
+}
+
+// Add adds a new HSM to the top-level config file.
+func (cs *ConfigSet) Add(cfg *Config) error {
+	if cfg.Hostname == "" {
+		return errors.New("Can't add an HSM without a hostname")
+	}
+	if err := cs.checkNames(cfg, -1); err != nil {
+		return err
+	}
+
+	base, err := cs.inherited(cs.loader.defaults[cs.path], cfg.Group)
+	if err != nil {
+		return err
+	}
+
+	doc, err := cs.doc(cs.path)
+	if err != nil {
+		return err
+	}
+
+	index := doc.appendHSM()
+	doc.writeFields(index, base, cfg, base)
+	cs.dirty[cs.path] = true
+
+	added := *cfg
+	added.inherit(base)
+
+	l := cs.loader
+	l.hsms = append(l.hsms, &added)
+	l.parents = append(l.parents, l.defaults[cs.path])
+	l.sources = append(l.sources, configSource{path: cs.path, index: index})
+
+	return nil
+}
+
+// Update calls the update callback with a copy of the named HSM's config and
+// saves the changes it makes.
+func (cs *ConfigSet) Update(name string, update func(*Config)) error {
+	i, err := cs.find(name)
+	if err != nil {
+		return err
+	}
+
+	l := cs.loader
+	if err = cs.checkStatic(i); err != nil {
+		return err
+	}
+
+	old := l.hsms[i]
+	cfg := *old
+	update(&cfg)
+
+	if cfg.Hostname == "" {
+		return errors.New("Can't remove an HSM's hostname")
+	}
+	if err = cs.checkNames(&cfg, i); err != nil {
+		return err
+	}
+
+	base, err := cs.inherited(l.parents[i], cfg.Group)
+	if err != nil {
+		return err
+	}
+	oldBase, err := cs.inherited(l.parents[i], old.Group)
+	if err != nil {
+		return err
+	}
+
+	src := l.sources[i]
+	doc, err := cs.doc(src.path)
+	if err != nil {
+		return err
+	}
+
+	doc.writeFields(src.index, old, &cfg, base)
+	cs.dirty[src.path] = true
+
+	// Inherit afresh, in case the group changed.
+	doc.dropInherited(src.index, old, &cfg, oldBase)
+	cfg.inherit(base)
+	l.hsms[i] = &cfg
+
+	return nil
+}
+
+// Remove removes the named HSM.
+func (cs *ConfigSet) Remove(name string) error {
+	i, err := cs.find(name)
+	if err != nil {
+		return err
+	}
+
+	l := cs.loader
+	if err = cs.checkStatic(i); err != nil {
+		return err
+	}
+
+	src := l.sources[i]
+
+	doc, err := cs.doc(src.path)
+	if err != nil {
+		return err
+	}
+
+	doc.removeHSM(src.index)
+	cs.dirty[src.path] = true
+
+	for j := range l.sources {
+		if l.sources[j].path == src.path && l.sources[j].index > src.index {
+			l.sources[j].index--
+		}
+	}
+
+	l.hsms = append(l.hsms[:i], l.hsms[i+1:]...)
+	l.parents = append(l.parents[:i], l.parents[i+1:]...)
+	l.sources = append(l.sources[:i], l.sources[i+1:]...)
+
+	return nil
+}
+
+// Save atomically writes any modified config files. Encrypted files are
+// re-encrypted the same way. File permissions are preserved, but plaintext
+// files containing passwords won't be written if they're world-readable.
+func (cs *ConfigSet) Save() error {
+	paths := make([]string, 0, len(cs.dirty))
+	for path := range cs.dirty {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if err := cs.save(path); err != nil {
+			return err
+		}
+		delete(cs.dirty, path)
+	}
+
+	return nil
+}
+
+func (cs *ConfigSet) save(path string) error {
+	doc := cs.docs[path]
+
+	data, err := doc.marshal()
+	if err != nil {
+		return errors.Wrap(err, "Error encoding config file "+path)
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	var raw []byte
+	var passphrase []byte
+	if f := cs.loader.files[path]; f != nil {
+		raw, passphrase = f.raw, f.passphrase
+	}
+
+	switch ConfigEncryption(raw) {
+	case EncryptionPassphrase:
+		if data, err = EncryptConfig(data, passphrase); err != nil {
+			return err
+		}
+	case EncryptionPGP:
+		keyring, err := LoadKeyring(os.Getenv(KeyringEnv))
+		if err != nil {
+			return err
+		}
+		recipients, err := ConfigRecipients(raw, keyring)
+		if err != nil {
+			return err
+		}
+		if data, err = EncryptConfigTo(data, recipients); err != nil {
+			return err
+		}
+	default:
+		if mode&0004 != 0 && doc.hasSecrets() {
+			return fmt.Errorf("Refusing to write passwords to world-readable file %s", path)
+		}
+	}
+
+	return WriteFileAtomic(path, data, mode)
+}
+
+// find returns the index of the HSM with the given nickname or hostname.
+func (cs *ConfigSet) find(name string) (int, error) {
+	found := -1
+
+	for i, cfg := range cs.loader.hsms {
+		if cfg.Nickname == name || cfg.Hostname == name {
+			if found >= 0 {
+				return -1, fmt.Errorf("Multiple configs with name %s", name)
+			}
+			found = i
+		}
+	}
+
+	if found < 0 {
+		return -1, fmt.Errorf("No config with name %s", name)
+	}
+
+	return found, nil
+}
+
+// checkStatic checks that the HSM at index i was defined in a config file,
+// rather than coming from an inventory.
+func (cs *ConfigSet) checkStatic(i int) error {
+	if inv := cs.loader.sources[i].inventory; inv != "" {
+		return fmt.Errorf("%s comes from inventory '%s' and can't be modified", cs.loader.hsms[i].Name(), inv)
+	}
+	return nil
+}
+
+// checkNames checks that the config's names aren't used by any HSM other than
+// the one at index self.
+func (cs *ConfigSet) checkNames(cfg *Config, self int) error {
+	for i, other := range cs.loader.hsms {
+		if i == self {
+			continue
+		}
+
+		for _, name := range []string{cfg.Nickname, cfg.Hostname} {
+			if name != "" && (other.Nickname == name || other.Hostname == name) {
+				return fmt.Errorf("Name %s is already used by %s", name, other.Name())
+			}
+		}
+	}
+
+	return nil
+}
+
+// inherited returns the settings an HSM in the given group would inherit.
+func (cs *ConfigSet) inherited(defaults *Config, group string) (*Config, error) {
+	base := new(Config)
+
+	if group == "" && defaults != nil {
+		group = defaults.Group
+	}
+
+	if group != "" {
+		g, ok := cs.loader.groups[group]
+		if !ok {
+			return nil, fmt.Errorf("Undefined group %s", group)
+		}
+		base.inherit(g)
+	}
+	base.inherit(defaults)
+
+	return base, nil
+}
+
+// doc returns the editable document for a config file.
+func (cs *ConfigSet) doc(path string) (*configDoc, error) {
+	if doc, ok := cs.docs[path]; ok {
+		return doc, nil
+	}
+
+	var plain []byte
+	if f := cs.loader.files[path]; f != nil {
+		plain = f.plain
+	}
+
+	doc, err := parseConfigDoc(plain, ConfigFormat(path))
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing config file "+path)
+	}
+
+	cs.docs[path] = doc
+	return doc, nil
+}
+
+// configDoc is an editable config file. All formats are edited as YAML nodes,
+// since YAML is a superset of JSON and keeps track of key order and comments.
+type configDoc struct {
+	format string
+	doc    *yaml.Node
+}
+
+func parseConfigDoc(data []byte, format string) (*configDoc, error) {
+	doc := new(yaml.Node)
+
+	if format == FormatTOML {
+		var v map[string]interface{}
+		if _, err := toml.Decode(string(data), &v); err != nil {
+			return nil, err
+		}
+		if err := doc.Encode(v); err != nil {
+			return nil, err
+		}
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{doc}}
+	} else if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+
+	if len(doc.Content) == 0 {
+		doc = &yaml.Node{
+			Kind:    yaml.DocumentNode,
+			Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}},
+		}
+	}
+
+	return &configDoc{format: format, doc: doc}, nil
+}
+
+func (d *configDoc) root() *yaml.Node {
+	return d.doc.Content[0]
+}
+
+// hsms returns the sequence of HSMs, creating it if necessary.
+func (d *configDoc) hsms() *yaml.Node {
+	root := d.root()
+	if root.Kind == yaml.SequenceNode {
+		return root
+	}
+
+	if node := mappingValue(root, "hsms"); node != nil {
+		return node
+	}
+
+	node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "hsms"}, node)
+
+	return node
+}
+
+func (d *configDoc) appendHSM() int {
+	hsms := d.hsms()
+	hsms.Content = append(hsms.Content, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+	return len(hsms.Content) - 1
+}
+
+func (d *configDoc) removeHSM(index int) {
+	hsms := d.hsms()
+	hsms.Content = append(hsms.Content[:index], hsms.Content[index+1:]...)
+}
+
+// writeFields updates the fields of the HSM at index that changed from old to
+// cfg. Fields that match what the HSM inherits from base are removed.
+func (d *configDoc) writeFields(index int, old, cfg, base *Config) {
+	entry := d.hsms().Content[index]
+
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(cfg).Elem()
+	bv := reflect.ValueOf(base).Elem()
+	t := nv.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		value := nv.Field(i).Interface()
+		if reflect.DeepEqual(value, ov.Field(i).Interface()) {
+			continue
+		}
+
+		if nv.Field(i).IsZero() || reflect.DeepEqual(value, bv.Field(i).Interface()) {
+			deleteMappingValue(entry, key)
+		} else {
+			setMappingValue(entry, key, value)
+		}
+	}
+}
+
+// dropInherited clears the settings cfg inherited from base, leaving those
+// set on the HSM's entry in the document or changed by an update.
+func (d *configDoc) dropInherited(index int, old, cfg, base *Config) {
+	entry := d.hsms().Content[index]
+
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(cfg).Elem()
+	bv := reflect.ValueOf(base).Elem()
+	t := nv.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" || mappingValue(entry, key) != nil {
+			continue
+		}
+
+		value := nv.Field(i).Interface()
+		if reflect.DeepEqual(value, ov.Field(i).Interface()) && reflect.DeepEqual(value, bv.Field(i).Interface()) {
+			nv.Field(i).Set(reflect.Zero(t.Field(i).Type))
+		}
+	}
+}
+
+// hasSecrets reports whether the document contains any passwords.
+func (d *configDoc) hasSecrets() bool {
+	var v interface{}
+	if err := d.root().Decode(&v); err != nil {
+		return true
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return true
+	}
+
+	cf, err := parseConfigFile(data, FormatJSON)
+	if err != nil {
+		return true
+	}
+
+	entries := append([]*Config{cf.Defaults}, cf.HSMs...)
+	for _, group := range cf.Groups {
+		entries = append(entries, group)
+	}
+
+	for _, cfg := range entries {
+		if cfg != nil && (cfg.SSHpassword != "" || cfg.Password != "") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *configDoc) marshal() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+
+	switch d.format {
+	case FormatYAML:
+		enc := yaml.NewEncoder(buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(d.doc); err != nil {
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		var v map[string]interface{}
+		if err := d.root().Decode(&v); err != nil {
+			return nil, err
+		}
+		if err := toml.NewEncoder(buf).Encode(v); err != nil {
+			return nil, err
+		}
+	default:
+		if err := writeJSONNode(buf, d.root(), ""); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeJSONNode writes a YAML node as indented JSON, preserving key order.
+func writeJSONNode(buf *bytes.Buffer, n *yaml.Node, indent string) error {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, close, step := "{", "}", 2
+		if n.Kind == yaml.SequenceNode {
+			open, close, step = "[", "]", 1
+		}
+
+		if len(n.Content) == 0 {
+			buf.WriteString(open + close)
+			return nil
+		}
+
+		buf.WriteString(open + "\n")
+		for i := 0; i < len(n.Content); i += step {
+			buf.WriteString(indent + "  ")
+
+			if step == 2 {
+				key, _ := json.Marshal(n.Content[i].Value)
+				buf.Write(key)
+				buf.WriteString(": ")
+			}
+
+			if err := writeJSONNode(buf, n.Content[i+step-1], indent+"  "); err != nil {
+				return err
+			}
+
+			if i+step < len(n.Content) {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(indent + close)
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!int", "!!float", "!!bool":
+			buf.WriteString(n.Value)
+		case "!!null":
+			buf.WriteString("null")
+		default:
+			str, _ := json.Marshal(n.Value)
+			buf.Write(str)
+		}
+	default:
+		return fmt.Errorf("Can't encode YAML node kind %d as JSON", n.Kind)
+	}
+
+	return nil
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(n *yaml.Node, key string, value interface{}) {
+	vn := new(yaml.Node)
+	vn.Encode(value)
+
+	if existing := mappingValue(n, key); existing != nil {
+		// Keep any comments attached to the old value.
+		existing.Kind, existing.Tag, existing.Value, existing.Style = vn.Kind, vn.Tag, vn.Value, vn.Style
+		existing.Content = vn.Content
+		return
+	}
+
+	n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, vn)
+}
+
+func deleteMappingValue(n *yaml.Node, key string) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content = append(n.Content[:i], n.Content[i+2:]...)
+			return
+		}
+	}
+}
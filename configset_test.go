@@ -0,0 +1,268 @@
+package lunash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tempConfig copies a config file into a temporary directory.
+func tempConfig(t *testing.T, src string, mode os.FileMode) (string, func()) {
+	dir, err := ioutil.TempDir("", "lunash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, filepath.Base(src))
+	if err = ioutil.WriteFile(path, data, mode); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestConfigSetJSON(t *testing.T) {
+	path, cleanup := tempConfig(t, exampleConfigPath, 0640)
+	defer cleanup()
+
+	cs, err := OpenConfigSet(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Nil(t, cs.Update("hsm1", func(cfg *Config) {
+		cfg.SSHfingerprint = "SHA256:yv0u4ILh4aYY1GHGQpXu025WbZgUpJ0FBhjw18SgZPE"
+	}))
+	assert.Nil(t, cs.Remove("2.2.2.2"))
+	assert.Nil(t, cs.Add(&Config{
+		Nickname:       "hsm3",
+		Hostname:       "3.3.3.3",
+		SSHport:        22,
+		SSHlogin:       "admin",
+		SSHfingerprint: "SHA256:40QvIN7FAGgYxl+5UVoTskPK1zKswZcDzPCK6aZReuU",
+	}))
+
+	assert.NotNil(t, cs.Add(&Config{Hostname: "1.1.1.1"}))
+	assert.NotNil(t, cs.Update("hsm3", func(cfg *Config) { cfg.Nickname = "hsm1" }))
+	assert.NotNil(t, cs.Remove("doesnt_exist"))
+
+	if !assert.Nil(t, cs.Save()) {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	}
+
+	configs, err := LoadAllConfigs(path)
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(configs)) {
+		assert.Equal(t, "hsm1", configs[0].Nickname)
+		assert.Equal(t, "SHA256:yv0u4ILh4aYY1GHGQpXu025WbZgUpJ0FBhjw18SgZPE", configs[0].SSHfingerprint)
+		assert.Equal(t, "other_password", configs[0].Password)
+		assert.Equal(t, "hsm3", configs[1].Nickname)
+		assert.Equal(t, 22, configs[1].SSHport)
+	}
+}
+
+func TestConfigSetYAML(t *testing.T) {
+	path, cleanup := tempConfig(t, "./example_lunash.yaml", 0600)
+	defer cleanup()
+
+	cs, err := OpenConfigSet(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Setting a field to its inherited value removes it.
+	assert.Nil(t, cs.Update("2.2.2.2", func(cfg *Config) {
+		cfg.SSHport = 2222
+		cfg.SSHlogin = "root"
+		cfg.Certs = []string{"ca.pem", "client.pem"}
+	}))
+	assert.Nil(t, cs.Add(&Config{
+		Hostname:       "3.3.3.3",
+		SSHport:        22,
+		SSHlogin:       "admin",
+		SSHfingerprint: "SHA256:40QvIN7FAGgYxl+5UVoTskPK1zKswZcDzPCK6aZReuU",
+	}))
+	if !assert.Nil(t, cs.Save()) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Contains(t, string(data), "# Settings shared by every HSM.")
+	assert.Contains(t, string(data), "ssh_login: root")
+	assert.Equal(t, 2, strings.Count(string(data), "ssh_port"))
+
+	configs, err := LoadAllConfigs(path)
+	if assert.Nil(t, err) && assert.Equal(t, 3, len(configs)) {
+		assert.Equal(t, 2222, configs[1].SSHport)
+		assert.Equal(t, "root", configs[1].SSHlogin)
+		assert.Equal(t, []string{"ca.pem", "client.pem"}, configs[1].Certs)
+		assert.Equal(t, "3.3.3.3", configs[2].Hostname)
+		assert.Equal(t, 22, configs[2].SSHport)
+		assert.Equal(t, "admin", configs[2].SSHlogin)
+	}
+}
+
+func TestConfigSetChangeGroup(t *testing.T) {
+	path, cleanup := tempConfig(t, "./example_lunash.yaml", 0600)
+	defer cleanup()
+
+	cs, err := OpenConfigSet(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Settings from the old group are replaced by the defaults.
+	assert.Nil(t, cs.Update("2.2.2.2", func(cfg *Config) { cfg.Group = "" }))
+
+	cfg, err := cs.Lookup("2.2.2.2")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "", cfg.Group)
+		assert.Equal(t, 22, cfg.SSHport)
+		assert.Equal(t, "admin", cfg.SSHlogin)
+		assert.Equal(t, "s3cret", cfg.SSHpassword)
+	}
+
+	assert.Nil(t, cs.Update("2.2.2.2", func(cfg *Config) { cfg.Group = "lab" }))
+
+	cfg, err = cs.Lookup("2.2.2.2")
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2222, cfg.SSHport)
+		assert.Equal(t, "somebody", cfg.SSHlogin)
+	}
+
+	if !assert.Nil(t, cs.Save()) {
+		return
+	}
+
+	configs, err := LoadAllConfigs(path)
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(configs)) {
+		assert.Equal(t, cfg, configs[1])
+	}
+}
+
+func TestConfigSetIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lunash")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"lunash.toml", "conf.d/10-dc2.yaml", "conf.d/20-legacy.json"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if !assert.Nil(t, err) {
+			return
+		}
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700)
+		if !assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0600)) {
+			return
+		}
+	}
+
+	cs, err := OpenConfigSet(filepath.Join(dir, "lunash.toml"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Nil(t, cs.Update("hsm3", func(cfg *Config) { cfg.SSHport = 2022 }))
+	assert.Nil(t, cs.Update("hsm1", func(cfg *Config) { cfg.Nickname = "hsm0" }))
+	if !assert.Nil(t, cs.Save()) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "conf.d/20-legacy.json"))
+	if assert.Nil(t, err) {
+		assert.Contains(t, string(data), `"ssh_port": 2022`)
+	}
+
+	configs, err := LoadAllConfigs(filepath.Join(dir, "lunash.toml"))
+	if assert.Nil(t, err) && assert.Equal(t, 3, len(configs)) {
+		assert.Equal(t, "hsm0", configs[0].Nickname)
+		assert.Equal(t, "password", configs[0].SSHpassword)
+		assert.Equal(t, 2022, configs[2].SSHport)
+	}
+}
+
+func TestConfigSetSecrets(t *testing.T) {
+	path, cleanup := tempConfig(t, exampleConfigPath, 0644)
+	defer cleanup()
+
+	cs, err := OpenConfigSet(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Nil(t, cs.Update("hsm1", func(cfg *Config) { cfg.SSHport = 2022 }))
+	assert.NotNil(t, cs.Save())
+
+	// Encrypted files may be world-readable.
+	plain, _ := ioutil.ReadFile(path)
+	enc, err := EncryptConfig(plain, []byte("hunter2"))
+	if !assert.Nil(t, err) || !assert.Nil(t, ioutil.WriteFile(path, enc, 0644)) {
+		return
+	}
+
+	withPassphrase("hunter2", func() {
+		cs, err := OpenConfigSet(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		assert.Nil(t, cs.Update("hsm1", func(cfg *Config) { cfg.SSHport = 2022 }))
+		assert.Nil(t, cs.Save())
+
+		data, _ := ioutil.ReadFile(path)
+		assert.Equal(t, EncryptionPassphrase, ConfigEncryption(data))
+
+		configs, err := LoadAllConfigs(path)
+		if assert.Nil(t, err) {
+			assert.Equal(t, 2022, configs[0].SSHport)
+		}
+	})
+}
+
+func TestConfigSetNewFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lunash")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lunash.json")
+
+	cs, err := OpenConfigSet(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Nil(t, cs.Add(&Config{Hostname: "1.1.1.1", SSHport: 22, SSHpassword: "s3cret"}))
+	if !assert.Nil(t, cs.Save()) {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	configs, err := LoadAllConfigs(path)
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(configs)) {
+		assert.Equal(t, "s3cret", configs[0].SSHpassword)
+	}
+}
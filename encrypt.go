@@ -0,0 +1,319 @@
+package lunash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Encryption methods for config files.
+const (
+	EncryptionNone       = ""
+	EncryptionPassphrase = "passphrase"
+	EncryptionPGP        = "pgp"
+)
+
+const (
+	secretboxBlockType = "LUNASH ENCRYPTED CONFIG"
+	pgpBlockType       = "PGP MESSAGE"
+
+	// scrypt parameters recommended for interactive logins.
+	scryptN      = 32768
+	scryptR      = 8
+	scryptP      = 1
+	scryptSaltSz = 32
+)
+
+// PassphraseEnv is the environment variable checked for a config passphrase
+// before prompting on the terminal.
+const PassphraseEnv = "LUNASH_PASSPHRASE"
+
+// KeyringEnv is the environment variable naming the PGP keyring used to
+// decrypt configs that were encrypted to recipients.
+const KeyringEnv = "LUNASH_KEYRING"
+
+// PassphrasePrompt is called when a passphrase is needed to decrypt a config
+// file or to unlock a PGP private key.
+var PassphrasePrompt = promptPassphrase
+
+// ConfigEncryption returns the method that the config file data was encrypted
+// with, or EncryptionNone.
+func ConfigEncryption(data []byte) string {
+	data = bytes.TrimSpace(data)
+
+	switch {
+	case bytes.HasPrefix(data, []byte("-----BEGIN "+secretboxBlockType+"-----")):
+		return EncryptionPassphrase
+	case bytes.HasPrefix(data, []byte("-----BEGIN "+pgpBlockType+"-----")):
+		return EncryptionPGP
+	default:
+		return EncryptionNone
+	}
+}
+
+// EncryptConfig encrypts config file data with a key derived from the
+// passphrase.
+func EncryptConfig(data, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, scryptSaltSz)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, errors.Wrap(err, "Error generating salt")
+	}
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, errors.Wrap(err, "Error generating nonce")
+	}
+
+	key, err := deriveKey(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{
+		Type: secretboxBlockType,
+		Headers: map[string]string{
+			"KDF":  fmt.Sprintf("scrypt,%d,%d,%d", scryptN, scryptR, scryptP),
+			"Salt": base64.StdEncoding.EncodeToString(salt),
+		},
+		Bytes: secretbox.Seal(nonce[:], data, &nonce, key),
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+// EncryptConfigTo encrypts config file data to the given PGP recipients.
+func EncryptConfigTo(data []byte, recipients openpgp.EntityList) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("No PGP recipients given")
+	}
+
+	buf := bytes.NewBuffer(nil)
+
+	aw, err := armor.Encode(buf, pgpBlockType, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error armoring config")
+	}
+
+	pw, err := openpgp.Encrypt(aw, recipients, nil, nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error encrypting config")
+	}
+
+	if _, err = pw.Write(data); err != nil {
+		return nil, errors.Wrap(err, "Error encrypting config")
+	}
+	if err = pw.Close(); err != nil {
+		return nil, errors.Wrap(err, "Error encrypting config")
+	}
+	if err = aw.Close(); err != nil {
+		return nil, errors.Wrap(err, "Error armoring config")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecryptConfig decrypts config file data. Data that isn't encrypted is
+// returned unchanged.
+func DecryptConfig(data []byte) ([]byte, error) {
+	return decryptConfig(data, PassphrasePrompt)
+}
+
+func decryptConfig(data []byte, prompt func(string) ([]byte, error)) ([]byte, error) {
+	switch ConfigEncryption(data) {
+	case EncryptionPassphrase:
+		return decryptSecretbox(data, prompt)
+	case EncryptionPGP:
+		keyring, err := LoadKeyring(os.Getenv(KeyringEnv))
+		if err != nil {
+			return nil, err
+		}
+		plain, _, err := decryptPGP(data, keyring, prompt)
+		return plain, err
+	default:
+		return data, nil
+	}
+}
+
+// ConfigRecipients returns the entities in the keyring that PGP encrypted
+// config file data was encrypted to.
+func ConfigRecipients(data []byte, keyring openpgp.EntityList) (openpgp.EntityList, error) {
+	_, ids, err := decryptPGP(data, keyring, PassphrasePrompt)
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients openpgp.EntityList
+	for _, id := range ids {
+		for _, key := range keyring.KeysById(id) {
+			recipients = append(recipients, key.Entity)
+		}
+	}
+
+	if len(recipients) == 0 {
+		return nil, errors.New("No config recipients found in keyring")
+	}
+
+	return recipients, nil
+}
+
+// LoadKeyring loads an armored or binary PGP keyring from the given path.
+func LoadKeyring(path string) (openpgp.EntityList, error) {
+	if path == "" {
+		return nil, fmt.Errorf("Config is PGP encrypted, but %s isn't set", KeyringEnv)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading keyring")
+	}
+
+	var keyring openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN ")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing keyring")
+	}
+
+	return keyring, nil
+}
+
+func decryptSecretbox(data []byte, prompt func(string) ([]byte, error)) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != secretboxBlockType {
+		return nil, errors.New("Bad encrypted config")
+	}
+
+	var n, r, p int
+	if _, err := fmt.Sscanf(block.Headers["KDF"], "scrypt,%d,%d,%d", &n, &r, &p); err != nil {
+		return nil, errors.Wrap(err, "Error parsing encrypted config KDF")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing encrypted config salt")
+	}
+
+	if len(block.Bytes) < 24+secretbox.Overhead {
+		return nil, errors.New("Encrypted config is truncated")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], block.Bytes[:24])
+
+	passphrase, err := prompt("Config passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(passphrase, salt, n, r, p)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, ok := secretbox.Open(nil, block.Bytes[24:], &nonce, key)
+	if !ok {
+		return nil, errors.New("Error decrypting config. Wrong passphrase?")
+	}
+
+	return plain, nil
+}
+
+// decryptPGP decrypts an armored PGP message, returning the plaintext and the
+// IDs of the keys it was encrypted to.
+func decryptPGP(data []byte, keyring openpgp.EntityList, prompt func(string) ([]byte, error)) ([]byte, []uint64, error) {
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error reading encrypted config")
+	}
+	if block.Type != pgpBlockType {
+		return nil, nil, errors.New("Bad encrypted config")
+	}
+
+	tried := false
+	keyPrompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if tried || symmetric {
+			return nil, errors.New("Error decrypting PGP private key")
+		}
+		tried = true
+
+		passphrase, err := prompt("PGP key passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+
+		// The passphrase only needs to unlock one of the keys.
+		decrypted := false
+		for _, key := range keys {
+			if key.PrivateKey != nil && key.PrivateKey.Encrypted {
+				if key.PrivateKey.Decrypt(passphrase) == nil {
+					decrypted = true
+				}
+			}
+		}
+		if !decrypted {
+			return nil, errors.New("Incorrect PGP key passphrase")
+		}
+
+		return nil, nil
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, keyring, keyPrompt, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error decrypting config")
+	}
+
+	plain, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error decrypting config")
+	}
+
+	return plain, md.EncryptedToKeyIds, nil
+}
+
+func deriveKey(passphrase, salt []byte, n, r, p int) (*[32]byte, error) {
+	k, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error deriving key from passphrase")
+	}
+
+	var key [32]byte
+	copy(key[:], k)
+
+	return &key, nil
+}
+
+// promptPassphrase reads a passphrase from the environment or the terminal.
+func promptPassphrase(prompt string) ([]byte, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, fmt.Errorf("Passphrase required, but stdin isn't a terminal and %s isn't set", PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading passphrase")
+	}
+
+	return passphrase, nil
+}
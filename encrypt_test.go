@@ -0,0 +1,171 @@
+package lunash
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func withPassphrase(passphrase string, cb func()) {
+	orig := PassphrasePrompt
+	defer func() { PassphrasePrompt = orig }()
+
+	PassphrasePrompt = func(string) ([]byte, error) {
+		return []byte(passphrase), nil
+	}
+
+	cb()
+}
+
+func TestEncryptConfig(t *testing.T) {
+	plain, err := ioutil.ReadFile(exampleConfigPath)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, EncryptionNone, ConfigEncryption(plain))
+
+	enc, err := EncryptConfig(plain, []byte("hunter2"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, EncryptionPassphrase, ConfigEncryption(enc))
+	assert.False(t, bytes.Contains(enc, []byte("other_password")))
+
+	withPassphrase("hunter2", func() {
+		dec, err := DecryptConfig(enc)
+		if assert.Nil(t, err) {
+			assert.Equal(t, plain, dec)
+		}
+	})
+
+	withPassphrase("wrong", func() {
+		_, err := DecryptConfig(enc)
+		assert.NotNil(t, err)
+	})
+
+	dir, err := ioutil.TempDir("", "lunash")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lunash.json")
+	if !assert.Nil(t, ioutil.WriteFile(path, enc, 0600)) {
+		return
+	}
+
+	withPassphrase("hunter2", func() {
+		configs, err := LoadAllConfigs(path)
+		if assert.Nil(t, err) {
+			assert.Equal(t, 2, len(configs))
+			assert.Equal(t, "other_password", configs[0].Password)
+		}
+	})
+}
+
+func TestEncryptConfigTo(t *testing.T) {
+	plain, err := ioutil.ReadFile(exampleConfigPath)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	entity, err := openpgp.NewEntity("ops", "", "ops@example.com", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Keys generated by gpg advertise SHA256, but NewEntity doesn't.
+	for _, id := range entity.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8}
+	}
+
+	enc, err := EncryptConfigTo(plain, openpgp.EntityList{entity})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, EncryptionPGP, ConfigEncryption(enc))
+
+	dir, err := ioutil.TempDir("", "lunash")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	keyring := bytes.NewBuffer(nil)
+	w, err := armor.Encode(keyring, openpgp.PrivateKeyType, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, entity.SerializePrivate(w, nil))
+	assert.Nil(t, w.Close())
+
+	keyringPath := filepath.Join(dir, "keyring.asc")
+	if !assert.Nil(t, ioutil.WriteFile(keyringPath, keyring.Bytes(), 0600)) {
+		return
+	}
+
+	orig := os.Getenv(KeyringEnv)
+	defer os.Setenv(KeyringEnv, orig)
+	os.Setenv(KeyringEnv, keyringPath)
+
+	dec, err := DecryptConfig(enc)
+	if assert.Nil(t, err) {
+		assert.Equal(t, plain, dec)
+	}
+
+	el, err := LoadKeyring(keyringPath)
+	if assert.Nil(t, err) {
+		recipients, err := ConfigRecipients(enc, el)
+		if assert.Nil(t, err) && assert.Equal(t, 1, len(recipients)) {
+			assert.Equal(t, entity.PrimaryKey.KeyId, recipients[0].PrimaryKey.KeyId)
+		}
+	}
+
+	_, err = EncryptConfigTo(plain, nil)
+	assert.NotNil(t, err)
+}
+
+func TestEncryptConfigToPassphraseKey(t *testing.T) {
+	plain, err := ioutil.ReadFile(exampleConfigPath)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Generated by gpg, protected by the passphrase "hunter2".
+	const keyringPath = "./testdata/keyring-passphrase.asc"
+
+	keyring, err := LoadKeyring(keyringPath)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	enc, err := EncryptConfigTo(plain, keyring)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	orig := os.Getenv(KeyringEnv)
+	defer os.Setenv(KeyringEnv, orig)
+	os.Setenv(KeyringEnv, keyringPath)
+
+	withPassphrase("wrong", func() {
+		_, err := DecryptConfig(enc)
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "Incorrect PGP key passphrase")
+		}
+	})
+
+	withPassphrase("hunter2", func() {
+		dec, err := DecryptConfig(enc)
+		if assert.Nil(t, err) {
+			assert.Equal(t, plain, dec)
+		}
+	})
+}
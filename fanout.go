@@ -0,0 +1,85 @@
+package lunash
+
+import (
+	"sync"
+	"time"
+)
+
+// Result is the outcome of running a function against one HSM with ForEach.
+type Result struct {
+	Config   *Config
+	Err      error
+	Duration time.Duration
+}
+
+// ForEach connects to each HSM and calls fn with its Client, running up to
+// parallel HSMs at once. Clients are closed after fn returns. The results are
+// in the same order as configs.
+func ForEach(configs []*Config, parallel int, fn func(*Config, *Client) error) []Result {
+	return ForEachIndex(configs, parallel, func(_ int, config *Config, client *Client) error {
+		return fn(config, client)
+	})
+}
+
+// ForEachIndex is like ForEach, but also passes fn the config's index, so
+// that callers can collect per-HSM output without sharing state between
+// calls, even if a config is listed twice.
+func ForEachIndex(configs []*Config, parallel int, fn func(int, *Config, *Client) error) []Result {
+	return forEach(configs, parallel, func(i int, config *Config) error {
+		client := config.Client()
+		if err := client.Connect(); err != nil {
+			return err
+		}
+
+		err := fn(i, config, client)
+
+		if cerr := client.Close(); err == nil {
+			err = cerr
+		}
+
+		return err
+	})
+}
+
+// forEach calls fn with each config and its index, running up to parallel at
+// once.
+func forEach(configs []*Config, parallel int, fn func(int, *Config) error) []Result {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	results := make([]Result, len(configs))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	for i, config := range configs {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, config *Config) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			start := time.Now()
+			err := fn(i, config)
+			results[i] = Result{Config: config, Err: err, Duration: time.Since(start)}
+		}(i, config)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// Failed returns the results that have errors.
+func Failed(results []Result) []Result {
+	var failed []Result
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,60 @@
+package lunash
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForEach(t *testing.T) {
+	configs := []*Config{{Nickname: "hsm1"}, {Nickname: "hsm2"}, {Nickname: "hsm3"}, {Hostname: "4.4.4.4"}}
+
+	var running, most int32
+	results := forEach(configs, 2, func(i int, config *Config) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+
+		if config.Name() == "hsm2" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	assert.Equal(t, int32(2), most)
+
+	if assert.Equal(t, 4, len(results)) {
+		for i, result := range results {
+			assert.Equal(t, configs[i], result.Config)
+		}
+	}
+
+	failed := Failed(results)
+	if assert.Equal(t, 1, len(failed)) {
+		assert.Equal(t, "hsm2", failed[0].Config.Name())
+	}
+}
+
+func TestForEachDuplicateConfigs(t *testing.T) {
+	config := &Config{Nickname: "hsm1"}
+	configs := []*Config{config, config}
+
+	// Each call gets its own index, even for the same config.
+	seen := make([]bool, len(configs))
+	results := forEach(configs, 2, func(i int, config *Config) error {
+		seen[i] = true
+		return nil
+	})
+
+	assert.Equal(t, []bool{true, true}, seen)
+	assert.Equal(t, 2, len(results))
+}
@@ -0,0 +1,144 @@
+package lunash
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileEntry is a file in the HSM's file area, as listed by "my file list".
+type FileEntry struct {
+	Name string
+	Size int64
+
+	// Date is the file's modification time, in the HSM's time zone. It's
+	// accurate to the minute for recent files and to the day for older ones.
+	Date time.Time
+}
+
+// ListFiles lists the files in the HSM's file area.
+func (c *Client) ListFiles() ([]FileEntry, error) {
+	outputs, err := c.Run([]string{"my file list"}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFileList(outputs[0], time.Now()), nil
+}
+
+// StatFile returns the entry for the named file in the HSM's file area, or nil
+// if there's no such file.
+func (c *Client) StatFile(name string) (*FileEntry, error) {
+	files, err := c.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	return findFile(files, name), nil
+}
+
+// DeleteFile deletes a file from the HSM's file area.
+func (c *Client) DeleteFile(name string) error {
+	if name == "" || strings.ContainsAny(name, "/ \t\r\n") {
+		return fmt.Errorf("Bad file name '%s'", name)
+	}
+
+	_, err := c.Run([]string{fmt.Sprintf("my file delete -file %s -force", name)}, false)
+	return err
+}
+
+// VerifyFiles checks that files in the HSM's file area have the expected
+// sizes, according to "my file list". Files are named by their paths on the
+// HSM. Only sizes are compared, since the listing doesn't include digests, so a
+// file corrupted without changing its size won't be noticed.
+func (c *Client) VerifyFiles(sizes map[string]int64) error {
+	files, err := c.ListFiles()
+	if err != nil {
+		return err
+	}
+
+	for name, size := range sizes {
+		file := findFile(files, name)
+		if file == nil {
+			return fmt.Errorf("Verification failed: %s isn't on the HSM", name)
+		}
+		if file.Size != size {
+			return fmt.Errorf("Verification failed: %s is %d bytes on the HSM, but %d bytes were sent", name, file.Size, size)
+		}
+	}
+
+	return nil
+}
+
+// findFile finds the file with the given path in a listing. The file area is
+// flat, so only the path's base name is compared.
+func findFile(files []FileEntry, name string) *FileEntry {
+	name = path.Base(name)
+
+	for i := range files {
+		if files[i].Name == name {
+			return &files[i]
+		}
+	}
+
+	return nil
+}
+
+// parseFileList parses the output of "my file list". Lines that don't describe
+// a file are ignored. Like ls, recent files are listed with a time and older
+// ones with a year, so now is needed to work out the year of recent files.
+//
+// Eg.
+//
+//	1192 Mar 20 10:31 server.pem
+//	size| date       | name
+func parseFileList(output string, now time.Time) []FileEntry {
+	var files []FileEntry
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		date, err := parseFileDate(fields[1], fields[2], fields[3], now)
+		if err != nil {
+			continue
+		}
+
+		files = append(files, FileEntry{
+			Name: strings.Join(fields[4:], " "),
+			Size: size,
+			Date: date,
+		})
+	}
+
+	return files
+}
+
+// parseFileDate parses a date like "Mar 20 10:31" or "Mar 20 2016".
+func parseFileDate(month, day, timeOrYear string, now time.Time) (time.Time, error) {
+	if !strings.ContainsRune(timeOrYear, ':') {
+		return time.ParseInLocation("Jan 2 2006", month+" "+day+" "+timeOrYear, now.Location())
+	}
+
+	date, err := time.ParseInLocation("Jan 2 15:04", month+" "+day+" "+timeOrYear, now.Location())
+	if err != nil {
+		return date, err
+	}
+
+	// Recent files are from within the last year.
+	date = date.AddDate(now.Year(), 0, 0)
+	if date.After(now.AddDate(0, 0, 1)) {
+		date = date.AddDate(-1, 0, 0)
+	}
+
+	return date, nil
+}
@@ -0,0 +1,35 @@
+package lunash
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fileListOutput = `
+        1192 Mar 20 10:31 server.pem
+        1261 Mar 21  2016 client one.pem
+    10485760 Dec  2 08:15 firmware.spkg
+           7 Bad 99 99:99 bad.txt
+
+`
+
+func TestParseFileList(t *testing.T) {
+	now := time.Date(2017, time.April, 2, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, []FileEntry{
+		{Name: "server.pem", Size: 1192, Date: time.Date(2017, time.March, 20, 10, 31, 0, 0, time.UTC)},
+		{Name: "client one.pem", Size: 1261, Date: time.Date(2016, time.March, 21, 0, 0, 0, 0, time.UTC)},
+		{Name: "firmware.spkg", Size: 10485760, Date: time.Date(2016, time.December, 2, 8, 15, 0, 0, time.UTC)},
+	}, parseFileList(fileListOutput, now))
+}
+
+func TestFindFile(t *testing.T) {
+	files := parseFileList(fileListOutput, time.Now())
+
+	if file := findFile(files, "./certs/server.pem"); assert.NotNil(t, file) {
+		assert.Equal(t, int64(1192), file.Size)
+	}
+	assert.Nil(t, findFile(files, "missing.pem"))
+}
@@ -0,0 +1,185 @@
+package lunash
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// fileStore is the part of Client that FS uses.
+type fileStore interface {
+	ListFiles() ([]FileEntry, error)
+	ScpGet(path string) ([]byte, error)
+}
+
+// FS is a read-only view of the HSM's file area. Directory entries come from
+// "my file list" and files are read over SCP. The file area is flat, so the
+// only directory is ".".
+type FS struct {
+	store fileStore
+}
+
+// FS returns a read-only filesystem view of the HSM's file area.
+func (c *Client) FS() *FS {
+	return &FS{store: c}
+}
+
+var (
+	_ fs.FS        = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// Open implements fs.FS. Files are read into memory when they're opened.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if name == "." {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{entries: entries}, nil
+	}
+
+	info, err := fsys.Stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+	}
+
+	data, err := fsys.store.ScpGet(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &file{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+// ReadDir implements fs.ReadDirFS. Entries are sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		if _, err := fsys.Stat(name); err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: unwrapPathError(err)}
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+
+	files, err := fsys.store.ListFiles()
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(files))
+	for _, file := range files {
+		if fs.ValidPath(file.Name) && file.Name != "." {
+			entries = append(entries, fs.FileInfoToDirEntry(fileEntryInfo{file}))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// Stat implements fs.StatFS.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return rootInfo{}, nil
+	}
+
+	files, err := fsys.store.ListFiles()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	for _, file := range files {
+		if file.Name == name {
+			return fileEntryInfo{file}, nil
+		}
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// errNotDir is returned when reading a file as a directory.
+var errNotDir = &notDirError{}
+
+type notDirError struct{}
+
+func (*notDirError) Error() string { return "not a directory" }
+
+func unwrapPathError(err error) error {
+	if perr, ok := err.(*fs.PathError); ok {
+		return perr.Err
+	}
+	return err
+}
+
+// fileEntryInfo is the fs.FileInfo for a file in the file area.
+type fileEntryInfo struct {
+	entry FileEntry
+}
+
+func (fi fileEntryInfo) Name() string       { return fi.entry.Name }
+func (fi fileEntryInfo) Size() int64        { return fi.entry.Size }
+func (fi fileEntryInfo) Mode() fs.FileMode  { return 0444 }
+func (fi fileEntryInfo) ModTime() time.Time { return fi.entry.Date }
+func (fi fileEntryInfo) IsDir() bool        { return false }
+func (fi fileEntryInfo) Sys() interface{}   { return &fi.entry }
+
+// rootInfo is the fs.FileInfo for the file area itself.
+type rootInfo struct{}
+
+func (rootInfo) Name() string       { return "." }
+func (rootInfo) Size() int64        { return 0 }
+func (rootInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (rootInfo) ModTime() time.Time { return time.Time{} }
+func (rootInfo) IsDir() bool        { return true }
+func (rootInfo) Sys() interface{}   { return nil }
+
+// file is an open file, read into memory.
+type file struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Close() error               { return nil }
+
+// dirFile is the open file area.
+type dirFile struct {
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return rootInfo{}, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: fs.ErrInvalid}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+
+	return rest[:n], nil
+}
@@ -0,0 +1,54 @@
+package lunash
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore is a fileStore backed by a map.
+type fakeStore map[string]string
+
+func (s fakeStore) ListFiles() ([]FileEntry, error) {
+	var files []FileEntry
+	for name, data := range s {
+		files = append(files, FileEntry{Name: name, Size: int64(len(data)), Date: time.Unix(1490000000, 0)})
+	}
+	return files, nil
+}
+
+func (s fakeStore) ScpGet(path string) ([]byte, error) {
+	return []byte(s[path]), nil
+}
+
+func TestFS(t *testing.T) {
+	fsys := &FS{store: fakeStore{
+		"server.pem": "server cert",
+		"client.pem": "client cert",
+		"empty.txt":  "",
+	}}
+
+	if err := fstest.TestFS(fsys, "server.pem", "client.pem", "empty.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := fs.Glob(fsys, "*.pem")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"client.pem", "server.pem"}, matches)
+	}
+
+	data, err := fs.ReadFile(fsys, "server.pem")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "server cert", string(data))
+	}
+
+	_, err = fsys.Open("missing.pem")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	_, err = fsys.ReadDir("server.pem")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,161 @@
+package lunash
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mastahyeti/lunash/parse"
+)
+
+// HSMInfo is the appliance and HSM details reported by "hsm show".
+type HSMInfo struct {
+	// SoftwareVersion is the appliance software version, eg. "6.2.0-8".
+	SoftwareVersion string
+
+	Label    string
+	Serial   string
+	Model    string
+	Firmware string
+
+	// AuthMethod is "Password" or "PED keys".
+	AuthMethod string
+
+	// LoggedIn is whether the HSM admin (SO) is logged in.
+	LoggedIn bool
+
+	// LoginAttemptsLeft is the number of bad HSM admin logins left before
+	// the HSM is zeroized.
+	LoginAttemptsLeft int
+
+	Zeroized bool
+
+	// FIPS is whether the HSM is in FIPS 140 approved operation mode.
+	FIPS bool
+
+	// Storage sizes, in bytes.
+	StorageTotal int64
+	StorageUsed  int64
+	StorageFree  int64
+
+	// Partitions are the partitions on the HSM.
+	Partitions []HSMPartition
+}
+
+// HSMPartition is a partition listed by "hsm show".
+type HSMPartition struct {
+	Serial string
+	Name   string
+}
+
+// Field names that differ between Luna 5, 6 and 7 appliances. The first name
+// found is used.
+var (
+	hsmModelKeys      = []string{"HSM Model", "Hardware Model"}
+	hsmLoginKeys      = []string{"HSM Admin login status", "SO login status"}
+	hsmAttemptsKeys   = []string{"HSM Admin login attempts left", "SO login attempts left"}
+	hsmStorageKeys    = []string{"Maximum HSM Storage Space (Bytes)", "Total HSM Storage Space (Bytes)"}
+	hsmStorageUseKeys = []string{"Space In Use (Bytes)", "Used HSM Storage Space (Bytes)"}
+)
+
+// HSMInfo runs "hsm show" and returns the appliance and HSM details.
+func (c *Client) HSMInfo() (*HSMInfo, error) {
+	outputs, err := c.Run([]string{"hsm show"}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseHSMInfo(outputs[0])
+}
+
+// parseHSMInfo parses the output of "hsm show".
+func parseHSMInfo(output string) (*HSMInfo, error) {
+	out := parse.Parse(output)
+	fields := out.Fields()
+
+	info := &HSMInfo{
+		SoftwareVersion: lookup(fields, "Software Version"),
+		Label:           lookup(fields, "HSM Label"),
+		Serial:          lookup(fields, "Serial #"),
+		Model:           lookup(fields, hsmModelKeys...),
+		Firmware:        lookup(fields, "Firmware"),
+		AuthMethod:      lookup(fields, "Authentication Method"),
+		LoggedIn:        strings.EqualFold(lookup(fields, hsmLoginKeys...), "Logged In"),
+		Zeroized:        strings.EqualFold(lookup(fields, "Manually Zeroized"), "Yes"),
+	}
+
+	if info.Serial == "" {
+		return nil, fmt.Errorf("Error parsing 'hsm show' output: no serial number")
+	}
+
+	var err error
+	if info.LoginAttemptsLeft, err = leadingInt(lookup(fields, hsmAttemptsKeys...)); err != nil {
+		return nil, fmt.Errorf("Error parsing 'hsm show' output: bad login attempts '%s'", lookup(fields, hsmAttemptsKeys...))
+	}
+
+	sizes := []struct {
+		dst  *int64
+		keys []string
+	}{
+		{&info.StorageTotal, hsmStorageKeys},
+		{&info.StorageUsed, hsmStorageUseKeys},
+		{&info.StorageFree, []string{"Free Space Left (Bytes)"}},
+	}
+	for _, size := range sizes {
+		value := lookup(fields, size.keys...)
+		if value == "" {
+			continue
+		}
+		if *size.dst, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("Error parsing 'hsm show' output: bad size '%s'", value)
+		}
+	}
+
+	// The FIPS section is "FIPS 140-2 Operation" before Luna 7 and "FIPS 140
+	// HSM Operation" after.
+	for _, section := range out.Sections {
+		if strings.HasPrefix(section.Title, "FIPS 140") {
+			text := strings.Join(section.Text, " ")
+			info.FIPS = strings.Contains(text, "approved operation mode") && !strings.Contains(text, " NOT ")
+		}
+	}
+
+	if section := out.Section("Partitions created on HSM"); section != nil {
+		for _, f := range section.Fields {
+			if !strings.EqualFold(f.Key, "Partition") {
+				continue
+			}
+			// "Partition: 532018011, Name: part1"
+			parts := strings.SplitN(f.Value, ", Name:", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("Error parsing 'hsm show' output: bad partition '%s'", f.Value)
+			}
+			info.Partitions = append(info.Partitions, HSMPartition{
+				Serial: strings.TrimSpace(parts[0]),
+				Name:   strings.TrimSpace(parts[1]),
+			})
+		}
+	}
+
+	return info, nil
+}
+
+// lookup returns the value of the first of the keys found in the fields.
+func lookup(fields parse.Record, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := fields.Get(key); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// leadingInt parses the number at the start of a value like "3 before HSM
+// zeroization!". Empty values are zero.
+func leadingInt(value string) (int, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	return strconv.Atoi(fields[0])
+}
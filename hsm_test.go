@@ -0,0 +1,84 @@
+package lunash
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHSMInfo(t *testing.T) {
+	tests := map[string]*HSMInfo{
+		"hsm_show_luna5.txt": {
+			SoftwareVersion:   "5.4.1-2",
+			Label:             "oldhsm",
+			Serial:            "150022",
+			Model:             "Luna K6 HSM",
+			Firmware:          "6.2.1",
+			AuthMethod:        "PED keys",
+			LoggedIn:          true,
+			LoginAttemptsLeft: 3,
+			FIPS:              true,
+			StorageTotal:      2097152,
+			StorageUsed:       104857,
+			StorageFree:       1992295,
+			Partitions:        []HSMPartition{{Serial: "150022008", Name: "legacy"}},
+		},
+		"hsm_show.txt": {
+			SoftwareVersion:   "6.2.0-8",
+			Label:             "myhsm",
+			Serial:            "532018",
+			Model:             "Luna K6 HSM",
+			Firmware:          "6.10.9",
+			AuthMethod:        "Password",
+			LoginAttemptsLeft: 3,
+			StorageTotal:      16252928,
+			StorageUsed:       204800,
+			StorageFree:       16048128,
+			Partitions: []HSMPartition{
+				{Serial: "532018011", Name: "part1"},
+				{Serial: "532018012", Name: "part2"},
+			},
+		},
+		"hsm_show_luna7.txt": {
+			SoftwareVersion:   "7.3.0-165",
+			Label:             "newhsm",
+			Serial:            "1280742",
+			Model:             "Luna K7",
+			Firmware:          "7.3.1",
+			AuthMethod:        "Password",
+			LoginAttemptsLeft: 3,
+			StorageTotal:      33554432,
+			StorageUsed:       2048000,
+			StorageFree:       31506432,
+			Partitions: []HSMPartition{
+				{Serial: "1280742000001", Name: "app"},
+				{Serial: "1280742000002", Name: "ca"},
+			},
+		},
+	}
+
+	for name, expected := range tests {
+		output, err := ioutil.ReadFile(filepath.Join("parse", "testdata", name))
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		info, err := parseHSMInfo(string(output))
+		if assert.Nil(t, err, name) {
+			assert.Equal(t, expected, info, name)
+		}
+	}
+}
+
+func TestParseHSMInfoErrors(t *testing.T) {
+	_, err := parseHSMInfo("HSM Label: myhsm\n")
+	assert.EqualError(t, err, "Error parsing 'hsm show' output: no serial number")
+
+	_, err = parseHSMInfo("Serial #: 1\nHSM Admin login attempts left: lots\n")
+	assert.EqualError(t, err, "Error parsing 'hsm show' output: bad login attempts 'lots'")
+
+	_, err = parseHSMInfo("Serial #: 1\nSpace In Use (Bytes): 1.5k\n")
+	assert.EqualError(t, err, "Error parsing 'hsm show' output: bad size '1.5k'")
+}
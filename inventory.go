@@ -0,0 +1,190 @@
+package lunash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Inventory is an external command that outputs HSM configs, like an Ansible
+// dynamic inventory script. The command is run with a "--list" argument and
+// must print either a JSON array of HSMs or a JSON object with "defaults",
+// "groups" and "hsms" keys, as in a config file.
+type Inventory struct {
+	// Command is the executable to run. Relative paths are relative to the
+	// config file.
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+
+	// TTL is how long the command's output is cached for, eg. "10m". By
+	// default it's run every time the config is loaded.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// InventoryCacheDir is where inventory command output is cached.
+var InventoryCacheDir = defaultInventoryCacheDir()
+
+func defaultInventoryCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "lunash", "inventory")
+}
+
+// load runs the inventory command, or reads its cached output, relative to the
+// config file in dir.
+func (inv *Inventory) load(dir string) (*configFile, error) {
+	if inv.Command == "" {
+		return nil, errors.New("Inventory is missing command")
+	}
+
+	command := inv.Command
+	if strings.ContainsRune(command, filepath.Separator) && !filepath.IsAbs(command) {
+		command = filepath.Join(dir, command)
+	}
+
+	var ttl time.Duration
+	if inv.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(inv.TTL); err != nil {
+			return nil, errors.Wrap(err, "Bad inventory ttl")
+		}
+	}
+
+	cachePath := inv.cachePath(command)
+
+	if ttl > 0 {
+		if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < ttl {
+			if data, err := ioutil.ReadFile(cachePath); err == nil {
+				return parseInventory(data)
+			}
+		}
+	}
+
+	data, err := inv.run(command)
+	if err != nil {
+		// Stale inventory is better than none.
+		if cached, cerr := ioutil.ReadFile(cachePath); ttl > 0 && cerr == nil {
+			log.Printf("Using stale inventory from %s: %s", cachePath, err)
+			return parseInventory(cached)
+		}
+		return nil, err
+	}
+
+	cf, err := parseInventory(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		if err = os.MkdirAll(InventoryCacheDir, 0700); err == nil {
+			err = WriteFileAtomic(cachePath, data, 0600)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Error caching inventory")
+		}
+	}
+
+	return cf, nil
+}
+
+func (inv *Inventory) run(command string) ([]byte, error) {
+	stdout := bytes.NewBuffer(nil)
+
+	cmd := exec.Command(command, append(inv.Args, "--list")...)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error running inventory command '%s'", inv.Command))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// cachePath is where the output of the command with the inventory's args is
+// cached.
+func (inv *Inventory) cachePath(command string) string {
+	key, _ := json.Marshal(append([]string{command}, inv.Args...))
+	sum := sha256.Sum256(key)
+	return filepath.Join(InventoryCacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func parseInventory(data []byte) (*configFile, error) {
+	cf, err := parseConfigFile(data, FormatJSON)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing inventory")
+	}
+
+	if len(cf.Include) > 0 || len(cf.Inventory) > 0 {
+		return nil, errors.New("Inventory may not include files or other inventories")
+	}
+
+	return cf, nil
+}
+
+// loadInventory loads the HSMs from an inventory referenced by the config
+// file at path. They're merged with the static HSMs once all files are loaded.
+func (l *configLoader) loadInventory(path string, inv *Inventory, defaults *Config) error {
+	cf, err := inv.load(filepath.Dir(path))
+	if err != nil {
+		return l.fail(path, err)
+	}
+
+	if cf.Defaults != nil {
+		cf.Defaults.inherit(defaults)
+		defaults = cf.Defaults
+	}
+
+	for name, group := range cf.Groups {
+		if _, dup := l.groups[name]; dup {
+			if err = l.fail(path, fmt.Errorf("Group %s from inventory '%s' is defined more than once", name, inv.Command)); err != nil {
+				return err
+			}
+		}
+		l.groups[name] = group
+	}
+
+	for i, hsm := range cf.HSMs {
+		l.inventory = append(l.inventory, hsm)
+		l.inventoryParents = append(l.inventoryParents, defaults)
+		l.inventorySources = append(l.inventorySources, configSource{path: path, index: i, inventory: inv.Command})
+	}
+
+	return nil
+}
+
+// mergeInventory merges HSMs from inventories with the static HSMs. Static
+// settings take precedence over those from the inventory.
+func (l *configLoader) mergeInventory() {
+	for i, hsm := range l.inventory {
+		merged := false
+
+		for _, static := range l.hsms {
+			if static.Hostname == hsm.Hostname && hsm.Hostname != "" {
+				static.inherit(hsm)
+				merged = true
+			}
+		}
+
+		if !merged {
+			l.hsms = append(l.hsms, hsm)
+			l.parents = append(l.parents, l.inventoryParents[i])
+			l.sources = append(l.sources, l.inventorySources[i])
+		}
+	}
+
+	l.inventory, l.inventoryParents, l.inventorySources = nil, nil, nil
+}
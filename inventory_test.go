@@ -0,0 +1,64 @@
+package lunash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAllConfigsInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lunash")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	origCache := InventoryCacheDir
+	defer func() { InventoryCacheDir = origCache }()
+	InventoryCacheDir = filepath.Join(dir, "cache")
+
+	count := filepath.Join(dir, "count")
+	origCount := os.Getenv("LUNASH_TEST_INVENTORY_COUNT")
+	defer os.Setenv("LUNASH_TEST_INVENTORY_COUNT", origCount)
+	os.Setenv("LUNASH_TEST_INVENTORY_COUNT", count)
+
+	for i := 0; i < 2; i++ {
+		configs, err := LoadAllConfigs("./testdata/inventory.yaml")
+		if !assert.Nil(t, err) || !assert.Equal(t, 2, len(configs)) {
+			return
+		}
+
+		// Static settings take precedence over the inventory's.
+		assert.Equal(t, "hsm1", configs[0].Nickname)
+		assert.Equal(t, "admin", configs[0].SSHlogin)
+		assert.Equal(t, "from_cmdb", configs[0].SSHpassword)
+		assert.Equal(t, 22, configs[0].SSHport)
+
+		assert.Equal(t, "prod-hsm4", configs[1].Nickname)
+		assert.Equal(t, "cmdb", configs[1].SSHlogin)
+		assert.Equal(t, 22, configs[1].SSHport)
+	}
+
+	// The second load was cached.
+	runs, err := ioutil.ReadFile(count)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 1, strings.Count(string(runs), "x"))
+	}
+
+	configs, err := LoadConfigs("./testdata/inventory.yaml", []string{"prod-hsm4"})
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(configs)) {
+		assert.Equal(t, "4.4.4.4", configs[0].Hostname)
+	}
+
+	_, err = LoadAllConfigsStrict("./testdata/inventory.yaml")
+	assert.Nil(t, err)
+
+	cs, err := OpenConfigSet("./testdata/inventory.yaml")
+	if assert.Nil(t, err) {
+		assert.NotNil(t, cs.Remove("prod-hsm4"))
+	}
+}
@@ -0,0 +1,225 @@
+package lunash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NTLSPort is the port NTLS listens on.
+const NTLSPort = 1792
+
+// NTLSCertPath is where the appliance keeps its NTLS server certificate in
+// the file area.
+const NTLSCertPath = "server.pem"
+
+// NTLSRotation is the result of regenerating an HSM's NTLS certificate.
+type NTLSRotation struct {
+	// HSM is the HSM's name and Hostname is how clients reach it.
+	HSM      string
+	Hostname string
+
+	OldPEM []byte
+	NewPEM []byte
+	Old    *x509.Certificate
+	New    *x509.Certificate
+}
+
+// NTLSCert fetches and parses the HSM's NTLS server certificate.
+func (c *Client) NTLSCert() ([]byte, *x509.Certificate, error) {
+	certPEM, err := c.ScpGet(NTLSCertPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error fetching NTLS certificate")
+	}
+
+	cert, err := parseCertPEM(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certPEM, cert, nil
+}
+
+// RotateNTLSCert regenerates the HSM's NTLS server certificate, binds NTLS to
+// the network device ("all" for every device) and restarts it. The old and
+// new certificates are returned, and the new one is checked with
+// VerifyRotation.
+//
+// Every client stops trusting the HSM until it has the new certificate, so
+// clients should be sent it straight away, with WriteBundle.
+func (c *Client) RotateNTLSCert(device string) (*NTLSRotation, error) {
+	if err := checkArg("network device", device); err != nil {
+		return nil, err
+	}
+
+	rotation := &NTLSRotation{HSM: c.config.Name(), Hostname: c.config.Hostname}
+
+	var err error
+	if rotation.OldPEM, rotation.Old, err = c.NTLSCert(); err != nil {
+		return nil, err
+	}
+
+	cmds := []string{
+		"sysconf regenCert -force",
+		fmt.Sprintf("ntls bind %s -force", device),
+		"service restart ntls",
+	}
+	if _, err = c.Run(cmds, true); err != nil {
+		return rotation, errors.Wrap(err, "Error regenerating NTLS certificate")
+	}
+
+	if rotation.NewPEM, rotation.New, err = c.NTLSCert(); err != nil {
+		return rotation, err
+	}
+
+	return rotation, rotation.Verify(time.Now())
+}
+
+// Verify checks that the certificate was replaced by one that's valid now and
+// has the same subject, so clients can keep connecting by the same name.
+func (r *NTLSRotation) Verify(now time.Time) error {
+	if bytes.Equal(r.Old.Raw, r.New.Raw) {
+		return fmt.Errorf("NTLS certificate on %s wasn't replaced", r.HSM)
+	}
+	if now.Before(r.New.NotBefore) {
+		return fmt.Errorf("New NTLS certificate on %s isn't valid until %s", r.HSM, r.New.NotBefore)
+	}
+	if now.After(r.New.NotAfter) {
+		return fmt.Errorf("New NTLS certificate on %s expired %s", r.HSM, r.New.NotAfter)
+	}
+	if r.New.Subject.CommonName != r.Old.Subject.CommonName {
+		return fmt.Errorf("New NTLS certificate on %s is for '%s', not '%s'", r.HSM, r.New.Subject.CommonName, r.Old.Subject.CommonName)
+	}
+	return nil
+}
+
+// VerifyServed checks that NTLS is serving the new certificate.
+func (r *NTLSRotation) VerifyServed(timeout time.Duration) error {
+	served, err := FetchServedCert(net.JoinHostPort(r.Hostname, strconv.Itoa(NTLSPort)), timeout)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(served.Raw, r.New.Raw) {
+		return fmt.Errorf("NTLS on %s is still serving the old certificate", r.HSM)
+	}
+	return nil
+}
+
+// FetchServedCert connects to a TLS server and returns its certificate. NTLS
+// requires a registered client certificate, so the handshake is abandoned
+// once the server's certificate has been seen.
+func FetchServedCert(addr string, timeout time.Duration) (*x509.Certificate, error) {
+	var served *x509.Certificate
+
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("no certificate")
+			}
+			cert, err := x509.ParseCertificate(raw[0])
+			if err != nil {
+				return err
+			}
+			served = cert
+			return nil
+		},
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, config)
+	if conn != nil {
+		conn.Close()
+	}
+	if served == nil {
+		if err == nil {
+			err = errors.New("no certificate")
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("Error fetching certificate served by %s", addr))
+	}
+
+	return served, nil
+}
+
+// bundleInstructions is the INSTALL file written in each client's bundle.
+var bundleInstructions = template.Must(template.New("INSTALL").Parse(`The NTLS certificate of HSM {{.HSM}} ({{.Hostname}}) was replaced on
+{{.Date}}. Until client {{.Client}} trusts the new certificate, it can't
+connect to the HSM.
+
+Replace the old certificate with {{.HSM}}.pem from this directory:
+
+    vtl deleteServer -n {{.Hostname}}
+    vtl addServer -n {{.Hostname}} -c {{.HSM}}.pem
+
+Then check that the HSM's partitions are visible:
+
+    vtl verify
+
+New certificate SHA-256 fingerprint:
+    {{.Fingerprint}}
+`))
+
+// WriteBundle saves the old and new certificates in dir, as
+// "<HSM>-server-old.pem" and "<HSM>-server.pem", and writes a bundle for each
+// client in "clients/<client>", with the new certificate and instructions for
+// installing it.
+func (r *NTLSRotation) WriteBundle(dir string, clients []NTLSClient) error {
+	files := map[string][]byte{
+		r.HSM + "-server-old.pem": r.OldPEM,
+		r.HSM + "-server.pem":     r.NewPEM,
+	}
+
+	for _, client := range clients {
+		var instructions bytes.Buffer
+		err := bundleInstructions.Execute(&instructions, map[string]string{
+			"HSM":         r.HSM,
+			"Hostname":    r.Hostname,
+			"Client":      client.Name,
+			"Date":        time.Now().Format("2006-01-02 15:04 MST"),
+			"Fingerprint": CertFingerprint(r.New),
+		})
+		if err != nil {
+			return errors.Wrap(err, "Error writing client instructions")
+		}
+
+		clientDir := filepath.Join("clients", client.Name)
+		files[filepath.Join(clientDir, r.HSM+".pem")] = r.NewPEM
+		files[filepath.Join(clientDir, "INSTALL")] = instructions.Bytes()
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Wrap(err, "Error creating bundle directory")
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return errors.Wrap(err, "Error writing "+path)
+		}
+	}
+
+	return nil
+}
+
+// CertFingerprint returns a certificate's SHA-256 fingerprint, in the
+// colon-separated form lunash uses.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	var buf bytes.Buffer
+	for i, b := range sum {
+		if i > 0 {
+			buf.WriteByte(':')
+		}
+		fmt.Fprintf(&buf, "%02X", b)
+	}
+	return buf.String()
+}
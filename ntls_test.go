@@ -0,0 +1,116 @@
+package lunash
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRotation(t *testing.T, oldCN, newCN string, notBefore time.Time) *NTLSRotation {
+	oldPEM := testCertPEM(t, oldCN)
+	newPEM, _ := testCertKey(t, newCN, notBefore, notBefore.Add(24*time.Hour))
+
+	old, err := parseCertPEM(oldPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := parseCertPEM(newPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &NTLSRotation{HSM: "hsm1", Hostname: "hsm1.example.com", OldPEM: oldPEM, NewPEM: newPEM, Old: old, New: cert}
+}
+
+func TestNTLSRotationVerify(t *testing.T) {
+	now := time.Now()
+
+	r := testRotation(t, "hsm1.example.com", "hsm1.example.com", now.Add(-time.Minute))
+	assert.Nil(t, r.Verify(now))
+
+	r.New, r.NewPEM = r.Old, r.OldPEM
+	assert.EqualError(t, r.Verify(now), "NTLS certificate on hsm1 wasn't replaced")
+
+	r = testRotation(t, "hsm1.example.com", "hsm1.example.com", now.Add(time.Hour))
+	assert.Contains(t, r.Verify(now).Error(), "New NTLS certificate on hsm1 isn't valid until")
+
+	r = testRotation(t, "hsm1.example.com", "hsm1.example.com", now.Add(-48*time.Hour))
+	assert.Contains(t, r.Verify(now).Error(), "New NTLS certificate on hsm1 expired")
+
+	r = testRotation(t, "hsm1.example.com", "localhost", now.Add(-time.Minute))
+	assert.EqualError(t, r.Verify(now), "New NTLS certificate on hsm1 is for 'localhost', not 'hsm1.example.com'")
+}
+
+func TestNTLSRotationWriteBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lunash-bundle")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r := testRotation(t, "hsm1.example.com", "hsm1.example.com", time.Now())
+	err = r.WriteBundle(dir, []NTLSClient{{Name: "app1"}, {Name: "app2"}})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Nil(t, err, name)
+		return string(data)
+	}
+
+	assert.Equal(t, string(r.OldPEM), read("hsm1-server-old.pem"))
+	assert.Equal(t, string(r.NewPEM), read("hsm1-server.pem"))
+	assert.Equal(t, string(r.NewPEM), read("clients/app2/hsm1.pem"))
+
+	install := read("clients/app1/INSTALL")
+	assert.Contains(t, install, "client app1 trusts the new certificate")
+	assert.Contains(t, install, "vtl addServer -n hsm1.example.com -c hsm1.pem")
+	assert.Contains(t, install, CertFingerprint(r.New))
+}
+
+func TestFetchServedCert(t *testing.T) {
+	certPEM, keyPEM := testCertKey(t, "hsm1.example.com", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Like NTLS, require a client certificate.
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	served, err := FetchServedCert(l.Addr().String(), time.Second)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "hsm1.example.com", served.Subject.CommonName)
+	}
+
+	_, err = FetchServedCert("127.0.0.1:1", time.Second)
+	if assert.NotNil(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "Error fetching certificate served by 127.0.0.1:1"))
+	}
+}
@@ -0,0 +1,313 @@
+// Package parse parses the free-form text output of lunash commands into
+// generic structured records.
+//
+// lunash output is made up of a few common shapes, often mixed in one
+// command's output:
+//
+//	HSM Details:                                  section title, underlined
+//	============
+//	HSM Label:                 myhsm              "Key: Value" field
+//	Password authentication ...... enabled       dotted-leader field
+//
+//	Users        Roles      Status               table header
+//	------------ ---------- -----------          separator
+//	admin        admin      enabled              row
+//
+// Parse splits output into sections at each title and collects the fields,
+// tables and any other text lines in each.
+package parse
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Output is parsed lunash output.
+type Output struct {
+	Sections []*Section `json:"sections"`
+}
+
+// Section is a part of the output, starting at a title. The first section's
+// title is empty if the output doesn't start with one.
+type Section struct {
+	Title  string   `json:"title"`
+	Fields Record   `json:"fields,omitempty"`
+	Tables []*Table `json:"tables,omitempty"`
+
+	// Text is the non-blank lines that aren't titles, fields or tables.
+	Text []string `json:"text,omitempty"`
+}
+
+// Field is a "Key: Value" or "Label .... Value" line.
+type Field struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Record is a list of fields, in the order they appeared.
+type Record []Field
+
+// Get returns the value of the first field with the given key, ignoring case.
+func (r Record) Get(key string) (string, bool) {
+	for _, f := range r {
+		if strings.EqualFold(f.Key, key) {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// Table is a table with a header line and a dashed separator line.
+type Table struct {
+	Headers []string   `json:"headers"`
+	Rows    [][]string `json:"rows"`
+}
+
+// Records returns each row as a record keyed by the headers.
+func (t *Table) Records() []Record {
+	records := make([]Record, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		record := make(Record, 0, len(row))
+		for i, value := range row {
+			if i < len(t.Headers) {
+				record = append(record, Field{Key: t.Headers[i], Value: value})
+			}
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// Section returns the first section with the given title, ignoring case and a
+// trailing colon, or nil.
+func (o *Output) Section(title string) *Section {
+	title = strings.TrimSuffix(title, ":")
+	for _, s := range o.Sections {
+		if strings.EqualFold(strings.TrimSuffix(s.Title, ":"), title) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Fields returns the fields from every section.
+func (o *Output) Fields() Record {
+	var fields Record
+	for _, s := range o.Sections {
+		fields = append(fields, s.Fields...)
+	}
+	return fields
+}
+
+// Get returns the value of the first field in any section with the given
+// key, ignoring case.
+func (o *Output) Get(key string) (string, bool) {
+	return o.Fields().Get(key)
+}
+
+// Tables returns the tables from every section.
+func (o *Output) Tables() []*Table {
+	var tables []*Table
+	for _, s := range o.Sections {
+		tables = append(tables, s.Tables...)
+	}
+	return tables
+}
+
+// Records splits the fields into records, starting a new record whenever a
+// key repeats. This handles output that lists several items, such as
+// partitions, as repeated blocks of the same fields.
+func (r Record) Records() []Record {
+	var records []Record
+	var current Record
+	seen := make(map[string]bool)
+
+	for _, f := range r {
+		key := strings.ToLower(f.Key)
+		if seen[key] {
+			records = append(records, current)
+			current, seen = nil, make(map[string]bool)
+		}
+		current = append(current, f)
+		seen[key] = true
+	}
+
+	if len(current) > 0 {
+		records = append(records, current)
+	}
+
+	return records
+}
+
+var (
+	// separatorRE matches table separators and title underlines.
+	separatorRE = regexp.MustCompile(`^\s*[-=]{3,}(\s+[-=]{3,})*\s*$`)
+
+	// dottedRE matches "Label .... Value", with an optional colon. Short
+	// leaders need a space before them so abbreviations aren't matched.
+	dottedRE = regexp.MustCompile(`^\s*(\S.*?)(?:\s+\.{2,}|\.{3,})\s*:?\s*(.*?)\s*$`)
+
+	// fieldRE matches "Key: Value". Keys don't start with a digit, which
+	// rules out times like "10:31".
+	fieldRE = regexp.MustCompile(`^\s*([^\s\d:][^:]{0,60}?)\s*:(?:\s+(.*?))?\s*$`)
+
+	// gapRE matches the gaps between columns, which are wider than the
+	// spaces within a column's values.
+	gapRE = regexp.MustCompile(`\s{2,}`)
+)
+
+// Parse parses lunash command output, as returned by Client.Run.
+func Parse(output string) *Output {
+	lines := strings.Split(strings.Replace(output, "\r\n", "\n", -1), "\n")
+
+	out := &Output{}
+	section := &Section{}
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t\r")
+		if strings.TrimSpace(line) == "" || isStatus(line) {
+			continue
+		}
+
+		next := ""
+		if i+1 < len(lines) {
+			next = lines[i+1]
+		}
+
+		if separatorRE.MatchString(next) {
+			// Group headings over some of a table's columns, like
+			// "Storage (bytes)", are followed by another header and
+			// separator. Skip them and parse the table below.
+			if i+3 < len(lines) && separatorRE.MatchString(lines[i+3]) {
+				i++
+				continue
+			}
+
+			if isTitle(line, next) {
+				if section.Title != "" || !section.empty() {
+					out.Sections = append(out.Sections, section)
+				}
+				section = &Section{Title: strings.TrimSpace(line)}
+				i++
+				continue
+			}
+
+			table, n := parseTable(lines[i:])
+			section.Tables = append(section.Tables, table)
+			i += n - 1
+			continue
+		}
+
+		if m := dottedRE.FindStringSubmatch(line); m != nil {
+			section.Fields = append(section.Fields, Field{Key: m[1], Value: m[2]})
+		} else if m := fieldRE.FindStringSubmatch(line); m != nil {
+			section.Fields = append(section.Fields, Field{Key: m[1], Value: m[2]})
+		} else {
+			section.Text = append(section.Text, strings.TrimSpace(line))
+		}
+	}
+
+	if section.Title != "" || !section.empty() {
+		out.Sections = append(out.Sections, section)
+	}
+
+	return out
+}
+
+// isStatus returns whether the line is the "Command Result" line that ends
+// raw lunash output. Client.Run strips it, but captured output may include it.
+func isStatus(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "Command Result :")
+}
+
+func (s *Section) empty() bool {
+	return len(s.Fields) == 0 && len(s.Tables) == 0 && len(s.Text) == 0
+}
+
+// isTitle returns whether a line followed by a separator is a section title
+// rather than a table header. Titles end in a colon or are a single column.
+func isTitle(line, separator string) bool {
+	if strings.HasSuffix(line, ":") {
+		return true
+	}
+	if len(strings.Fields(separator)) > 1 {
+		return false
+	}
+	return len(gapRE.Split(strings.TrimSpace(line), -1)) == 1
+}
+
+// parseTable parses a table starting at its header line, returning it and the
+// number of lines it spanned. The table ends at a blank line.
+func parseTable(lines []string) (*Table, int) {
+	header := strings.TrimRight(lines[0], " \t\r")
+	separator := strings.TrimRight(lines[1], " \t\r")
+
+	cols := columns(header, separator)
+
+	table := &Table{Headers: split(header, cols, 0)}
+
+	n := 2
+	for ; n < len(lines); n++ {
+		line := strings.TrimRight(lines[n], " \t\r")
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		if separatorRE.MatchString(line) {
+			continue
+		}
+		table.Rows = append(table.Rows, split(line, cols, len(table.Headers)))
+	}
+
+	return table, n
+}
+
+// columns returns the start offset of each column. Separators made of one
+// dash group per column give the offsets exactly. Otherwise, they're the
+// starts of the header's gap-separated names.
+func columns(header, separator string) []int {
+	var cols []int
+
+	if len(strings.Fields(separator)) > 1 {
+		for i := 0; i < len(separator); i++ {
+			if separator[i] != ' ' && (i == 0 || separator[i-1] == ' ') {
+				cols = append(cols, i)
+			}
+		}
+		return cols
+	}
+
+	start := len(header) - len(strings.TrimLeft(header, " "))
+	cols = append(cols, start)
+	for _, gap := range gapRE.FindAllStringIndex(header[start:], -1) {
+		cols = append(cols, start+gap[1])
+	}
+
+	return cols
+}
+
+// split splits a line into columns. Rows whose gap-separated values match the
+// number of columns are split on gaps, which copes with right-aligned
+// numbers. Otherwise, they're sliced at the column offsets.
+func split(line string, cols []int, want int) []string {
+	if want > 0 {
+		if values := gapRE.Split(strings.TrimSpace(line), -1); len(values) == want {
+			return values
+		}
+		if values := strings.Fields(line); len(values) == want {
+			return values
+		}
+	}
+
+	values := make([]string, len(cols))
+	for i, start := range cols {
+		end := len(line)
+		if i+1 < len(cols) && cols[i+1] < end {
+			end = cols[i+1]
+		}
+		if start < end {
+			values[i] = strings.TrimSpace(line[start:end])
+		}
+	}
+
+	return values
+}
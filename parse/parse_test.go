@@ -0,0 +1,104 @@
+package parse
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// TestGolden parses each testdata/*.txt capture of lunash output and compares
+// the result with the matching .golden file. Run with -update after adding a
+// capture to write its golden file.
+func TestGolden(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.txt")
+	if !assert.Nil(t, err) || !assert.NotEmpty(t, paths) {
+		return
+	}
+
+	for _, path := range paths {
+		input, err := ioutil.ReadFile(path)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		actual, err := json.MarshalIndent(Parse(string(input)), "", "  ")
+		if !assert.Nil(t, err) {
+			continue
+		}
+		actual = append(actual, '\n')
+
+		golden := strings.TrimSuffix(path, ".txt") + ".golden"
+		if *update {
+			assert.Nil(t, ioutil.WriteFile(golden, actual, 0644))
+			continue
+		}
+
+		expected, err := ioutil.ReadFile(golden)
+		if assert.Nil(t, err, path) {
+			assert.Equal(t, string(expected), string(actual), path)
+		}
+	}
+}
+
+func TestParseSections(t *testing.T) {
+	out := Parse(readTestdata(t, "hsm_show.txt"))
+
+	serial, ok := out.Get("serial #")
+	assert.True(t, ok)
+	assert.Equal(t, "532018", serial)
+
+	s := out.Section("HSM Storage Information")
+	if assert.NotNil(t, s) {
+		free, _ := s.Fields.Get("Free Space Left (Bytes)")
+		assert.Equal(t, "16048128", free)
+	}
+
+	s = out.Section("FIPS 140-2 Operation:")
+	if assert.NotNil(t, s) {
+		assert.Equal(t, []string{"The HSM is NOT in FIPS 140-2 approved operation mode."}, s.Text)
+	}
+
+	assert.Nil(t, out.Section("missing"))
+}
+
+func TestParseTables(t *testing.T) {
+	tables := Parse(readTestdata(t, "user_list.txt")).Tables()
+	if assert.Equal(t, 1, len(tables)) {
+		records := tables[0].Records()
+		if assert.Equal(t, 4, len(records)) {
+			name, _ := records[2].Get("full name")
+			assert.Equal(t, "Ops Monitor", name)
+		}
+	}
+
+	tables = Parse(readTestdata(t, "partition_list.txt")).Tables()
+	if assert.Equal(t, 1, len(tables)) {
+		assert.Equal(t, []string{"Partition", "Name", "Objects", "Total", "Used", "Free"}, tables[0].Headers)
+		assert.Equal(t, []string{"532018012", "part2", "12", "102400", "11872", "90528"}, tables[0].Rows[1])
+	}
+}
+
+func TestRecords(t *testing.T) {
+	records := Parse(readTestdata(t, "partition_show.txt")).Fields().Records()
+	if assert.Equal(t, 2, len(records)) {
+		name, _ := records[1].Get("Partition Name")
+		assert.Equal(t, "part2", name)
+		count, _ := records[1].Get("Object Count")
+		assert.Equal(t, "12", count)
+	}
+}
+
+func readTestdata(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
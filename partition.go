@@ -0,0 +1,305 @@
+package lunash
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mastahyeti/lunash/parse"
+)
+
+// Partition is a partition on the HSM, as listed by "partition list".
+type Partition struct {
+	Name   string
+	Serial string
+
+	// Label is the partition's label. Before Luna 7 it's the same as the
+	// name.
+	Label string
+
+	Objects int
+
+	// Storage sizes, in bytes.
+	StorageTotal int64
+	StorageUsed  int64
+	StorageFree  int64
+}
+
+// PartitionInfo is the details of a partition, as shown by "partition show".
+type PartitionInfo struct {
+	Partition
+
+	// Activated is whether the partition is activated for the crypto
+	// officer (partition owner before Luna 7).
+	Activated bool
+
+	// LoginAttemptsLeft is the number of bad crypto officer logins left
+	// before the partition is locked out or zeroized.
+	LoginAttemptsLeft int
+}
+
+// Partition errors. PartitionErrors wrap one of these, when the failure is
+// recognised, which is returned by errors.Cause.
+var (
+	ErrPartitionNotFound   = errors.New("partition not found")
+	ErrPartitionExists     = errors.New("partition already exists")
+	ErrInsufficientStorage = errors.New("insufficient HSM storage")
+	ErrIncorrectPassword   = errors.New("incorrect password")
+	ErrNotLoggedIn         = errors.New("not logged in to the HSM")
+)
+
+// partitionFailures maps substrings of lunash's error output to partition
+// errors.
+var partitionFailures = []struct {
+	match []string
+	err   error
+}{
+	{[]string{"does not exist", "not found", "INVALID_SLOT"}, ErrPartitionNotFound},
+	{[]string{"already exists", "ALREADY_EXISTS"}, ErrPartitionExists},
+	{[]string{"insufficient", "not enough", "NO_SPACE", "OUT_OF_MEMORY"}, ErrInsufficientStorage},
+	{[]string{"incorrect password", "PIN_INCORRECT", "PIN_INVALID"}, ErrIncorrectPassword},
+	{[]string{"not logged in", "NOT_LOGGED_IN", "USER_NOT_AUTHORIZED"}, ErrNotLoggedIn},
+}
+
+// PartitionError is returned when a partition operation fails.
+type PartitionError struct {
+	Op        string
+	Partition string
+
+	// Err is one of the partition errors, such as ErrPartitionNotFound, or
+	// the underlying error if the failure isn't recognised.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *PartitionError) Error() string {
+	return fmt.Sprintf("Error running partition %s for '%s': %s", e.Op, e.Partition, e.Err)
+}
+
+// Cause returns the partition error, for errors.Cause.
+func (e *PartitionError) Cause() error { return e.Err }
+
+// Unwrap returns the partition error, for errors.Is.
+func (e *PartitionError) Unwrap() error { return e.Err }
+
+// ListPartitions lists the partitions on the HSM.
+func (c *Client) ListPartitions() ([]Partition, error) {
+	outputs, err := c.Run([]string{"partition list"}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePartitionList(outputs[0])
+}
+
+// ShowPartition returns the details of the named partition.
+func (c *Client) ShowPartition(name string) (*PartitionInfo, error) {
+	if err := checkArg("partition name", name); err != nil {
+		return nil, err
+	}
+
+	outputs, err := c.Run([]string{fmt.Sprintf("partition show -partition %s", name)}, false)
+	if err != nil {
+		return nil, partitionError("show", name, err)
+	}
+
+	return parsePartitionShow(outputs[0])
+}
+
+// CreatePartition creates a partition with the given crypto officer password.
+// If size is zero, the HSM's default size is used. The HSM admin password
+// from the config is used to log in.
+func (c *Client) CreatePartition(name, password string, size int64) error {
+	if err := checkArg("partition name", name); err != nil {
+		return err
+	}
+	if err := checkArg("password", password); err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("partition create -partition %s -password %s", name, password)
+	if size > 0 {
+		cmd += fmt.Sprintf(" -size %d", size)
+	}
+
+	return c.runPartition("create", name, cmd+" -force")
+}
+
+// DeletePartition deletes a partition and all of its objects.
+func (c *Client) DeletePartition(name string) error {
+	if err := checkArg("partition name", name); err != nil {
+		return err
+	}
+
+	return c.runPartition("delete", name, fmt.Sprintf("partition delete -partition %s -force", name))
+}
+
+// ResizePartition changes a partition's storage size, in bytes.
+func (c *Client) ResizePartition(name string, size int64) error {
+	if err := checkArg("partition name", name); err != nil {
+		return err
+	}
+	if size <= 0 {
+		return fmt.Errorf("Bad partition size %d", size)
+	}
+
+	return c.runPartition("resize", name, fmt.Sprintf("partition resize -partition %s -size %d -force", name, size))
+}
+
+// ChangePartitionPassword changes a partition's crypto officer password.
+func (c *Client) ChangePartitionPassword(name, oldPassword, newPassword string) error {
+	if err := checkArg("partition name", name); err != nil {
+		return err
+	}
+	if err := checkArg("password", oldPassword); err != nil {
+		return err
+	}
+	if err := checkArg("password", newPassword); err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("partition changePw -partition %s -oldpw %s -newpw %s", name, oldPassword, newPassword)
+	return c.runPartition("changePw", name, cmd)
+}
+
+// runPartition runs a partition command as the HSM admin.
+func (c *Client) runPartition(op, name, cmd string) error {
+	if _, err := c.Run([]string{cmd}, true); err != nil {
+		return partitionError(op, name, err)
+	}
+	return nil
+}
+
+// partitionError maps a failed partition command to a PartitionError. The
+// command itself isn't kept, since it may contain passwords.
+func partitionError(op, name string, err error) error {
+	perr := &PartitionError{Op: op, Partition: name, Err: err}
+
+	cmdErr, ok := err.(*CommandError)
+	if !ok {
+		return perr
+	}
+
+	output := strings.ToLower(cmdErr.Output + " " + cmdErr.Status)
+	for _, failure := range partitionFailures {
+		for _, match := range failure.match {
+			if strings.Contains(output, strings.ToLower(match)) {
+				perr.Err = failure.err
+				return perr
+			}
+		}
+	}
+
+	perr.Err = fmt.Errorf("%s", strings.TrimSpace(cmdErr.Status))
+	return perr
+}
+
+// checkArg checks that a command argument won't be split or misread by
+// lunash.
+func checkArg(what, value string) error {
+	if value == "" || strings.ContainsAny(value, " \t\r\n;\"'") || strings.HasPrefix(value, "-") {
+		return fmt.Errorf("Bad %s", what)
+	}
+	return nil
+}
+
+// parsePartitionList parses the output of "partition list". Luna 7 lists
+// labels and allocated storage where earlier versions list names and total
+// storage.
+func parsePartitionList(output string) ([]Partition, error) {
+	var partitions []Partition
+
+	for _, table := range parse.Parse(output).Tables() {
+		for _, record := range table.Records() {
+			p := Partition{
+				Serial: lookup(record, "Partition"),
+				Name:   lookup(record, "Name", "Label"),
+				Label:  lookup(record, "Label", "Name"),
+			}
+
+			var err error
+			if p.Objects, err = strconv.Atoi(lookup(record, "Objects")); err != nil {
+				return nil, fmt.Errorf("Error parsing 'partition list' output: bad object count for '%s'", p.Name)
+			}
+			if err = parseSizes(record, &p, "Total", "Allocated"); err != nil {
+				return nil, fmt.Errorf("Error parsing 'partition list' output: %s", err)
+			}
+
+			partitions = append(partitions, p)
+		}
+	}
+
+	return partitions, nil
+}
+
+// parsePartitionShow parses the output of "partition show" for one partition.
+func parsePartitionShow(output string) (*PartitionInfo, error) {
+	fields := parse.Parse(output).Fields()
+
+	info := &PartitionInfo{}
+	info.Name = lookup(fields, "Partition Name")
+	info.Serial = lookup(fields, "Partition SN")
+	info.Label = lookup(fields, "Partition Label", "Partition Name")
+	info.Activated = isYes(lookup(fields, "Crypto Officer is activated", "Activated"))
+
+	if info.Serial == "" {
+		return nil, fmt.Errorf("Error parsing 'partition show' output: no serial number")
+	}
+
+	var err error
+	attempts := lookup(fields, "Crypto Officer Login Attempts Left", "Partition Owner Login Attempts Left")
+	if info.LoginAttemptsLeft, err = leadingInt(attempts); err != nil {
+		return nil, fmt.Errorf("Error parsing 'partition show' output: bad login attempts '%s'", attempts)
+	}
+	if info.Objects, err = leadingInt(lookup(fields, "Object Count")); err != nil {
+		return nil, fmt.Errorf("Error parsing 'partition show' output: bad object count")
+	}
+
+	storage := parse.Record{
+		{Key: "Total", Value: lookup(fields, "Total Storage Space")},
+		{Key: "Used", Value: lookup(fields, "Used Storage Space")},
+		{Key: "Free", Value: lookup(fields, "Free Storage Space")},
+	}
+	if err = parseSizes(storage, &info.Partition, "Total"); err != nil {
+		return nil, fmt.Errorf("Error parsing 'partition show' output: %s", err)
+	}
+
+	return info, nil
+}
+
+// parseSizes sets a partition's storage sizes from a record's total, "Used"
+// and "Free" fields. Missing sizes are left as zero.
+func parseSizes(record parse.Record, p *Partition, totalKeys ...string) error {
+	sizes := []struct {
+		dst  *int64
+		keys []string
+	}{
+		{&p.StorageTotal, totalKeys},
+		{&p.StorageUsed, []string{"Used"}},
+		{&p.StorageFree, []string{"Free"}},
+	}
+
+	for _, size := range sizes {
+		value := lookup(record, size.keys...)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad size '%s'", value)
+		}
+		*size.dst = n
+	}
+
+	return nil
+}
+
+// isYes returns whether a lunash flag value is set.
+func isYes(value string) bool {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on", "enabled":
+		return true
+	}
+	return false
+}
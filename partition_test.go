@@ -0,0 +1,88 @@
+package lunash
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func readParseTestdata(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join("parse", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParsePartitionList(t *testing.T) {
+	partitions, err := parsePartitionList(readParseTestdata(t, "partition_list.txt"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []Partition{
+			{Name: "part1", Serial: "532018011", Label: "part1", Objects: 3, StorageTotal: 102400, StorageUsed: 3336, StorageFree: 99064},
+			{Name: "part2", Serial: "532018012", Label: "part2", Objects: 12, StorageTotal: 102400, StorageUsed: 11872, StorageFree: 90528},
+		}, partitions)
+	}
+
+	partitions, err = parsePartitionList(readParseTestdata(t, "partition_list_luna7.txt"))
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(partitions)) {
+		assert.Equal(t, Partition{Name: "ca", Serial: "1280742000002", Label: "ca", Objects: 2, StorageTotal: 325896, StorageUsed: 4520, StorageFree: 321376}, partitions[1])
+	}
+
+	partitions, err = parsePartitionList("There are no partitions.\n")
+	assert.Nil(t, err)
+	assert.Empty(t, partitions)
+}
+
+func TestParsePartitionShow(t *testing.T) {
+	info, err := parsePartitionShow(readParseTestdata(t, "partition_show_luna7.txt"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, &PartitionInfo{
+			Partition: Partition{
+				Name:         "app",
+				Serial:       "1280742000001",
+				Label:        "app",
+				Objects:      5,
+				StorageTotal: 325896,
+				StorageUsed:  12488,
+				StorageFree:  313408,
+			},
+			Activated:         true,
+			LoginAttemptsLeft: 10,
+		}, info)
+	}
+
+	_, err = parsePartitionShow("Partition Name: part1\n")
+	assert.EqualError(t, err, "Error parsing 'partition show' output: no serial number")
+}
+
+func TestPartitionError(t *testing.T) {
+	err := partitionError("create", "part1", &CommandError{
+		Command: "partition create",
+		Status:  "Command Result : 65535 (Luna Shell execution)",
+		Output:  "Error: 'partition create' failed. A partition with that name already exists.",
+	})
+	assert.EqualError(t, err, "Error running partition create for 'part1': partition already exists")
+	assert.Equal(t, ErrPartitionExists, pkgerrors.Cause(err))
+	assert.True(t, errors.Is(err, ErrPartitionExists))
+
+	err = partitionError("delete", "part1", &CommandError{
+		Status: "Command Result : 65535 (Luna Shell execution)",
+		Output: "Error: something unexpected",
+	})
+	assert.EqualError(t, err, "Error running partition delete for 'part1': Command Result : 65535 (Luna Shell execution)")
+
+	other := errors.New("boom")
+	assert.Equal(t, other, pkgerrors.Cause(partitionError("show", "part1", other)))
+}
+
+func TestCheckArg(t *testing.T) {
+	assert.Nil(t, checkArg("partition name", "part1"))
+	assert.EqualError(t, checkArg("partition name", ""), "Bad partition name")
+	assert.EqualError(t, checkArg("password", "s3cret -force"), "Bad password")
+	assert.EqualError(t, checkArg("partition name", "-force"), "Bad partition name")
+	assert.EqualError(t, checkArg("password", "a;b"), "Bad password")
+}
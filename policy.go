@@ -0,0 +1,250 @@
+package lunash
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mastahyeti/lunash/parse"
+	"github.com/pkg/errors"
+)
+
+// Policy is an HSM or partition policy, as shown by "hsm showPolicies" or
+// "partition showPolicies".
+type Policy struct {
+	Code        int
+	Description string
+
+	// Value is the policy's value as shown, eg. "Allowed", "Off" or "20".
+	Value string
+
+	// Destructive is whether changing the policy zeroizes the HSM or
+	// partition.
+	Destructive bool
+}
+
+// IntValue returns the policy's value as it's given to "changePolicy".
+func (p Policy) IntValue() (int, error) {
+	return policyValue(p.Value)
+}
+
+// PolicyChange is a change to a policy's value.
+type PolicyChange struct {
+	Policy Policy
+	From   int
+	To     int
+}
+
+// String describes the change.
+func (c PolicyChange) String() string {
+	s := fmt.Sprintf("policy %d (%s): %d -> %d", c.Policy.Code, c.Policy.Description, c.From, c.To)
+	if c.Policy.Destructive {
+		s += " [destructive]"
+	}
+	return s
+}
+
+// DestructivePolicyError is returned when applying changes to destructive
+// policies without allowing it.
+type DestructivePolicyError struct {
+	Changes []PolicyChange
+}
+
+// Error implements the error interface.
+func (e *DestructivePolicyError) Error() string {
+	codes := make([]string, 0, len(e.Changes))
+	for _, change := range e.Changes {
+		codes = append(codes, strconv.Itoa(change.Policy.Code))
+	}
+	return fmt.Sprintf("Refusing to change destructive policies %s without permission", strings.Join(codes, ", "))
+}
+
+// HSMPolicies returns the HSM's policies.
+func (c *Client) HSMPolicies() ([]Policy, error) {
+	outputs, err := c.Run([]string{"hsm showPolicies"}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePolicies(outputs[0])
+}
+
+// PartitionPolicies returns the named partition's policies.
+func (c *Client) PartitionPolicies(name string) ([]Policy, error) {
+	if err := checkArg("partition name", name); err != nil {
+		return nil, err
+	}
+
+	outputs, err := c.Run([]string{fmt.Sprintf("partition showPolicies -partition %s", name)}, false)
+	if err != nil {
+		return nil, partitionError("showPolicies", name, err)
+	}
+
+	return parsePolicies(outputs[0])
+}
+
+// ApplyHSMPolicies changes HSM policies, as the HSM admin. Changing a
+// destructive policy zeroizes the whole HSM, so it's refused with a
+// DestructivePolicyError unless destructive is set, and warned about if it
+// is.
+func (c *Client) ApplyHSMPolicies(changes []PolicyChange, destructive bool) error {
+	if err := checkDestructive(changes, destructive, "the HSM"); err != nil {
+		return err
+	}
+
+	cmds := make([]string, 0, len(changes))
+	for _, change := range changes {
+		cmds = append(cmds, fmt.Sprintf("hsm changePolicy -policy %d -value %d -force", change.Policy.Code, change.To))
+	}
+
+	return c.applyPolicies(cmds)
+}
+
+// ApplyPartitionPolicies changes a partition's policies, as the HSM admin.
+// Destructive policies are handled like ApplyHSMPolicies, but they zeroize
+// only the partition.
+func (c *Client) ApplyPartitionPolicies(name string, changes []PolicyChange, destructive bool) error {
+	if err := checkArg("partition name", name); err != nil {
+		return err
+	}
+	if err := checkDestructive(changes, destructive, fmt.Sprintf("partition '%s'", name)); err != nil {
+		return err
+	}
+
+	cmds := make([]string, 0, len(changes))
+	for _, change := range changes {
+		cmds = append(cmds, fmt.Sprintf("partition changePolicy -partition %s -policy %d -value %d -force", name, change.Policy.Code, change.To))
+	}
+
+	return c.applyPolicies(cmds)
+}
+
+func (c *Client) applyPolicies(cmds []string) error {
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	if _, err := c.Run(cmds, true); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error changing policies on %s", c.config.Name()))
+	}
+	return nil
+}
+
+// checkDestructive refuses destructive changes unless they're allowed, and
+// logs a warning for each one that is.
+func checkDestructive(changes []PolicyChange, allowed bool, target string) error {
+	var destructive []PolicyChange
+	for _, change := range changes {
+		if change.Policy.Destructive {
+			destructive = append(destructive, change)
+		}
+	}
+
+	if len(destructive) == 0 {
+		return nil
+	}
+	if !allowed {
+		return &DestructivePolicyError{Changes: destructive}
+	}
+
+	for _, change := range destructive {
+		log.Printf("WARNING: changing %s will ZEROIZE %s", change, target)
+	}
+	return nil
+}
+
+// DiffPolicies returns the changes needed to give policies their desired
+// values, ordered by code. Desired policies are keyed by code or description
+// and their values may be numbers or words like "Allowed" and "Off".
+func DiffPolicies(current []Policy, desired map[string]string) ([]PolicyChange, error) {
+	byCode := make(map[int]Policy, len(current))
+	byDescription := make(map[string]Policy, len(current))
+	for _, policy := range current {
+		byCode[policy.Code] = policy
+		byDescription[strings.ToLower(policy.Description)] = policy
+	}
+
+	var changes []PolicyChange
+	seen := make(map[int]bool)
+
+	for key, value := range desired {
+		policy, ok := byDescription[strings.ToLower(strings.TrimSpace(key))]
+		if code, err := strconv.Atoi(strings.TrimSpace(key)); err == nil {
+			policy, ok = byCode[code]
+		}
+		if !ok {
+			return nil, fmt.Errorf("Unknown policy '%s'", key)
+		}
+		if seen[policy.Code] {
+			return nil, fmt.Errorf("Policy %d is given more than once", policy.Code)
+		}
+		seen[policy.Code] = true
+
+		to, err := policyValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Bad value '%s' for policy '%s'", value, key)
+		}
+		from, err := policy.IntValue()
+		if err != nil {
+			return nil, fmt.Errorf("Bad current value '%s' for policy %d", policy.Value, policy.Code)
+		}
+
+		if from != to {
+			changes = append(changes, PolicyChange{Policy: policy, From: from, To: to})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Policy.Code < changes[j].Policy.Code
+	})
+
+	return changes, nil
+}
+
+// parsePolicies parses the output of "hsm showPolicies" or "partition
+// showPolicies". Capabilities are listed in tables without codes and are
+// skipped.
+func parsePolicies(output string) ([]Policy, error) {
+	var policies []Policy
+
+	for _, table := range parse.Parse(output).Tables() {
+		for _, record := range table.Records() {
+			code, ok := record.Get("Code")
+			if !ok {
+				break
+			}
+
+			policy := Policy{
+				Description: lookup(record, "Description"),
+				Value:       lookup(record, "Value"),
+				Destructive: isYes(lookup(record, "Destructive")),
+			}
+
+			var err error
+			if policy.Code, err = strconv.Atoi(code); err != nil {
+				return nil, fmt.Errorf("Error parsing policies: bad code '%s' for '%s'", code, policy.Description)
+			}
+
+			policies = append(policies, policy)
+		}
+	}
+
+	if len(policies) == 0 {
+		return nil, fmt.Errorf("Error parsing policies: no policies found")
+	}
+
+	return policies, nil
+}
+
+// policyValue converts a policy value to the number "changePolicy" takes.
+func policyValue(value string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "allowed", "enabled", "on", "yes", "true":
+		return 1, nil
+	case "disallowed", "disabled", "off", "no", "false":
+		return 0, nil
+	}
+	return strconv.Atoi(strings.TrimSpace(value))
+}
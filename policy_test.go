@@ -0,0 +1,62 @@
+package lunash
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := parsePolicies(readParseTestdata(t, "hsm_showpolicies.txt"))
+	if assert.Nil(t, err) && assert.Equal(t, 8, len(policies)) {
+		assert.Equal(t, Policy{Code: 7, Description: "Allow cloning", Value: "Allowed", Destructive: true}, policies[0])
+		assert.Equal(t, Policy{Code: 33, Description: "Current maximum number of partitions", Value: "20"}, policies[7])
+	}
+
+	policies, err = parsePolicies(readParseTestdata(t, "partition_showpolicies.txt"))
+	if assert.Nil(t, err) && assert.Equal(t, 8, len(policies)) {
+		assert.Equal(t, Policy{Code: 22, Description: "Allow activation", Value: "Off"}, policies[3])
+	}
+
+	_, err = parsePolicies("Partition Name: part1\n")
+	assert.EqualError(t, err, "Error parsing policies: no policies found")
+}
+
+func TestDiffPolicies(t *testing.T) {
+	current, err := parsePolicies(readParseTestdata(t, "hsm_showpolicies.txt"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	changes, err := DiffPolicies(current, map[string]string{
+		"12":                                   "0",
+		"allow network replication":            "Allowed",
+		"Current maximum number of partitions": "10",
+		"15":                                   "off",
+	})
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(changes)) {
+		assert.Equal(t, 12, changes[0].Policy.Code)
+		assert.Equal(t, 1, changes[0].From)
+		assert.Equal(t, 0, changes[0].To)
+		assert.Equal(t, "policy 12 (Allow non-FIPS algorithms): 1 -> 0 [destructive]", changes[0].String())
+		assert.Equal(t, "policy 33 (Current maximum number of partitions): 20 -> 10", changes[1].String())
+	}
+
+	_, err = DiffPolicies(current, map[string]string{"99": "1"})
+	assert.EqualError(t, err, "Unknown policy '99'")
+
+	_, err = DiffPolicies(current, map[string]string{"Allow cloning": "maybe"})
+	assert.EqualError(t, err, "Bad value 'maybe' for policy 'Allow cloning'")
+
+	_, err = DiffPolicies(current, map[string]string{"7": "1", "allow cloning": "1"})
+	assert.EqualError(t, err, "Policy 7 is given more than once")
+}
+
+func TestCheckDestructive(t *testing.T) {
+	safe := PolicyChange{Policy: Policy{Code: 16}, From: 1, To: 0}
+	destructive := PolicyChange{Policy: Policy{Code: 12, Destructive: true}, From: 1, To: 0}
+
+	assert.Nil(t, checkDestructive([]PolicyChange{safe}, false, "the HSM"))
+	assert.EqualError(t, checkDestructive([]PolicyChange{safe, destructive}, false, "the HSM"), "Refusing to change destructive policies 12 without permission")
+	assert.Nil(t, checkDestructive([]PolicyChange{safe, destructive}, true, "the HSM"))
+}
@@ -0,0 +1,158 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress describes a file transfer in progress.
+type Progress struct {
+	Path string
+
+	// Bytes is how many of the file's Total bytes have been transferred.
+	Bytes int64
+	Total int64
+
+	// Rate is the average transfer rate in bytes per second.
+	Rate float64
+
+	// ETA is the estimated time until the transfer completes.
+	ETA time.Duration
+}
+
+// Done returns whether the transfer is complete.
+func (p *Progress) Done() bool {
+	return p.Bytes >= p.Total
+}
+
+// ProgressFunc is called as files are transferred.
+type ProgressFunc func(*Progress)
+
+// tracker counts the bytes transferred for a file.
+type tracker struct {
+	progress Progress
+	start    time.Time
+	fn       ProgressFunc
+}
+
+func newTracker(path string, total int64, fn ProgressFunc) *tracker {
+	t := &tracker{progress: Progress{Path: path, Total: total}, start: time.Now(), fn: fn}
+	fn(&t.progress)
+	return t
+}
+
+func (t *tracker) add(n int) {
+	if n == 0 {
+		return
+	}
+
+	p := &t.progress
+	p.Bytes += int64(n)
+
+	if elapsed := time.Since(t.start).Seconds(); elapsed > 0 {
+		p.Rate = float64(p.Bytes) / elapsed
+	}
+	if p.Rate > 0 {
+		p.ETA = time.Duration(float64(p.Total-p.Bytes) / p.Rate * float64(time.Second))
+	}
+
+	t.fn(p)
+}
+
+type progressReader struct {
+	r io.Reader
+	t *tracker
+}
+
+// NewProgressReader returns a reader that calls fn as the total bytes of the
+// file at path are read from r.
+func NewProgressReader(r io.Reader, path string, total int64, fn ProgressFunc) io.Reader {
+	return &progressReader{r: r, t: newTracker(path, total, fn)}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.t.add(n)
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	t *tracker
+}
+
+// NewProgressWriter returns a writer that calls fn as the total bytes of the
+// file at path are written to w.
+func NewProgressWriter(w io.Writer, path string, total int64, fn ProgressFunc) io.Writer {
+	return &progressWriter{w: w, t: newTracker(path, total, fn)}
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.t.add(n)
+	return n, err
+}
+
+// ProgressBar returns a ProgressFunc that draws a progress bar for each file on
+// w, which should be a terminal. Redraws are limited to ten per second.
+func ProgressBar(w io.Writer) ProgressFunc {
+	var mu sync.Mutex
+	var last time.Time
+
+	return func(p *Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !p.Done() && p.Bytes > 0 && time.Since(last) < 100*time.Millisecond {
+			return
+		}
+		last = time.Now()
+
+		fmt.Fprint(w, "\r"+formatProgress(p, 30))
+		if p.Done() {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// formatProgress formats a progress bar line with a bar of the given width.
+func formatProgress(p *Progress, width int) string {
+	frac := 1.0
+	if p.Total > 0 {
+		frac = float64(p.Bytes) / float64(p.Total)
+	}
+
+	filled := int(frac * float64(width))
+	bar := strings.Repeat("=", filled)
+	if filled < width {
+		bar += ">" + strings.Repeat(" ", width-filled-1)
+	}
+
+	eta := "--:--"
+	if p.Done() {
+		eta = "done "
+	} else if p.Rate > 0 {
+		secs := int(p.ETA.Seconds())
+		eta = fmt.Sprintf("%02d:%02d", secs/60, secs%60)
+	}
+
+	return fmt.Sprintf("%s %3d%% [%s] %s %s/s %s", p.Path, int(frac*100), bar, formatBytes(float64(p.Bytes)), formatBytes(p.Rate), eta)
+}
+
+// formatBytes formats a byte count with a binary unit suffix.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%d%s", int64(n), units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
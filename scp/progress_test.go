@@ -0,0 +1,51 @@
+package scp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressReader(t *testing.T) {
+	var updates []Progress
+
+	r := NewProgressReader(strings.NewReader("hello world"), "a.pem", 11, func(p *Progress) {
+		updates = append(updates, *p)
+	})
+
+	buf := make([]byte, 6)
+	r.Read(buf)
+	ioutil.ReadAll(r)
+
+	if assert.Equal(t, 3, len(updates)) {
+		assert.Equal(t, int64(0), updates[0].Bytes)
+		assert.Equal(t, int64(6), updates[1].Bytes)
+		assert.False(t, updates[1].Done())
+		assert.Equal(t, int64(11), updates[2].Bytes)
+		assert.True(t, updates[2].Done())
+		assert.Equal(t, time.Duration(0), updates[2].ETA)
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var last Progress
+
+	buf := bytes.NewBuffer(nil)
+	w := NewProgressWriter(buf, "a.pem", 5, func(p *Progress) { last = *p })
+	w.Write([]byte("hello"))
+
+	assert.Equal(t, "hello", buf.String())
+	assert.True(t, last.Done())
+}
+
+func TestFormatProgress(t *testing.T) {
+	p := &Progress{Path: "a.pem", Bytes: 512, Total: 2048, Rate: 256, ETA: 6 * time.Second}
+	assert.Equal(t, "a.pem  25% [==>       ] 512B 256B/s 00:06", formatProgress(p, 10))
+
+	p = &Progress{Path: "a.pem", Bytes: 3 << 20, Total: 3 << 20, Rate: 1536}
+	assert.Equal(t, "a.pem 100% [==========] 3.0MiB 1.5KiB/s done ", formatProgress(p, 10))
+}
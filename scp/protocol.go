@@ -0,0 +1,454 @@
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SCP protocol response codes.
+const (
+	respOK    = 0x00
+	respWarn  = 0x01
+	respFatal = 0x02
+)
+
+// RemoteError is an error reported by the remote scp process, such as a file
+// not existing or permission being denied.
+type RemoteError struct {
+	// Fatal is set if the remote scp process exited after the error.
+	Fatal   bool
+	Message string
+}
+
+// Error implements the error interface.
+func (e *RemoteError) Error() string {
+	return "Remote SCP error: " + e.Message
+}
+
+// ProtocolError is returned when the remote scp process sends something
+// unexpected.
+type ProtocolError struct {
+	Message string
+}
+
+// Error implements the error interface.
+func (e *ProtocolError) Error() string {
+	return "SCP protocol error: " + e.Message
+}
+
+// header is the metadata sent before a file's contents, from the "C" record
+// and the optional preceding "T" record.
+type header struct {
+	mode  os.FileMode
+	size  int64
+	name  string
+	mtime time.Time
+	atime time.Time
+}
+
+// conn is our end of an SCP protocol exchange.
+type conn struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+func newConn(stdin io.Writer, stdout io.Reader) *conn {
+	return &conn{w: stdin, r: bufio.NewReader(stdout)}
+}
+
+// ack tells the remote to continue.
+func (c *conn) ack() error {
+	debug("Writing null byte")
+	if _, err := c.w.Write([]byte{respOK}); err != nil {
+		return errors.Wrap(err, "Error writing reply to stdin")
+	}
+	return nil
+}
+
+// fail tells the remote that we've failed.
+func (c *conn) fail(msg string) {
+	debugf("Writing error: %s", msg)
+	c.w.Write([]byte(fmt.Sprintf("%c%s\n", respFatal, msg)))
+}
+
+// readAck waits for the remote to acknowledge a record or file contents.
+func (c *conn) readAck() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "Error reading reply from stdout")
+	}
+	debug("Read reply: ", b)
+
+	switch b {
+	case respOK:
+		return nil
+	case respWarn, respFatal:
+		return c.readRemoteError(b)
+	default:
+		return &ProtocolError{Message: fmt.Sprintf("unexpected reply %s", strconv.QuoteToASCII(string(b)))}
+	}
+}
+
+func (c *conn) readRemoteError(code byte) error {
+	msg, err := c.r.ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "Error reading error message from stdout")
+	}
+
+	return &RemoteError{
+		Fatal:   code == respFatal,
+		Message: strings.TrimSuffix(msg, "\n"),
+	}
+}
+
+// writeRecord sends a protocol record and waits for it to be acknowledged.
+func (c *conn) writeRecord(record string) error {
+	debugf("Writing record: %s", strconv.QuoteToASCII(record))
+	if _, err := c.w.Write([]byte(record)); err != nil {
+		return errors.Wrap(err, "Error writing record to stdin")
+	}
+	return c.readAck()
+}
+
+// readRecord reads a protocol record, returning its type and the rest of the
+// line. Error responses are returned as RemoteErrors.
+func (c *conn) readRecord() (byte, string, error) {
+	typ, err := c.r.ReadByte()
+	if err != nil {
+		return 0, "", err
+	}
+
+	if typ == respWarn || typ == respFatal {
+		return 0, "", c.readRemoteError(typ)
+	}
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return 0, "", errors.Wrap(err, "Error reading record from stdout")
+	}
+	debugf("Read record: %s", strconv.QuoteToASCII(string(typ)+line))
+
+	return typ, strings.TrimSuffix(line, "\n"), nil
+}
+
+// parseFileRecord parses the rest of a "C" or "D" record.
+//
+// Eg.
+//
+//	C0644 1192 server.pem
+//	mode| size| path
+func parseFileRecord(line string, hdr *header) error {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return &ProtocolError{Message: "bad file record " + strconv.QuoteToASCII(line)}
+	}
+
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return &ProtocolError{Message: "bad file mode " + strconv.QuoteToASCII(parts[0])}
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return &ProtocolError{Message: "bad file size " + strconv.QuoteToASCII(parts[1])}
+	}
+
+	if parts[2] == "" || strings.ContainsRune(parts[2], '/') || parts[2] == "." || parts[2] == ".." {
+		return &ProtocolError{Message: "bad file name " + strconv.QuoteToASCII(parts[2])}
+	}
+
+	hdr.mode = os.FileMode(mode).Perm()
+	hdr.size = size
+	hdr.name = parts[2]
+
+	return nil
+}
+
+// parseTimeRecord parses the rest of a "T" record.
+//
+// Eg.
+//
+//	T1490000000 0 1490000000 0
+//	mtime    |usec| atime   |usec
+func parseTimeRecord(line string, hdr *header) error {
+	var msec, musec, asec, ausec int64
+	if _, err := fmt.Sscanf(line, "%d %d %d %d", &msec, &musec, &asec, &ausec); err != nil {
+		return &ProtocolError{Message: "bad time record " + strconv.QuoteToASCII(line)}
+	}
+
+	hdr.mtime = time.Unix(msec, musec*1000)
+	hdr.atime = time.Unix(asec, ausec*1000)
+
+	return nil
+}
+
+// fileRecord formats a "C" record.
+func fileRecord(hdr *header) string {
+	return fmt.Sprintf("C%04o %d %s\n", hdr.mode.Perm(), hdr.size, hdr.name)
+}
+
+// dirRecord formats a "D" record.
+func dirRecord(hdr *header) string {
+	return fmt.Sprintf("D%04o 0 %s\n", hdr.mode.Perm(), hdr.name)
+}
+
+// timeRecord formats a "T" record.
+func timeRecord(hdr *header) string {
+	return fmt.Sprintf("T%d %d %d %d\n",
+		hdr.mtime.Unix(), hdr.mtime.Nanosecond()/1000,
+		hdr.atime.Unix(), hdr.atime.Nanosecond()/1000,
+	)
+}
+
+// send sends a file to the remote, which must be running "scp -t".
+func (c *conn) send(hdr *header, r io.Reader) error {
+	// The remote acknowledges that it's ready.
+	if err := c.readAck(); err != nil {
+		return err
+	}
+
+	return c.sendFile(hdr, r)
+}
+
+// sendFile sends a "T" record if the header has times, a "C" record and the
+// file's contents.
+func (c *conn) sendFile(hdr *header, r io.Reader) error {
+	if err := c.sendTimes(hdr); err != nil {
+		return err
+	}
+
+	if err := c.writeRecord(fileRecord(hdr)); err != nil {
+		return err
+	}
+
+	debug("Writing file")
+	n, err := io.CopyN(c.w, r, hdr.size)
+	if err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("File is %d bytes, but %d bytes were expected", n, hdr.size)
+		}
+		return errors.Wrap(err, "Error writing file to stdin")
+	}
+	debugf("Wrote %d bytes", n)
+
+	if err = c.ack(); err != nil {
+		return err
+	}
+
+	return c.readAck()
+}
+
+// sendPath sends a local file, or a directory and its contents if
+// opts.Recursive is set.
+func (c *conn) sendPath(path string, opts Options) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "Error reading file")
+	}
+
+	hdr := &header{mode: info.Mode().Perm(), size: info.Size(), name: filepath.Base(path)}
+	if opts.Preserve {
+		hdr.mtime, hdr.atime = info.ModTime(), info.ModTime()
+	}
+
+	if info.IsDir() {
+		if !opts.Recursive {
+			return fmt.Errorf("%s is a directory", path)
+		}
+		return c.sendDir(path, hdr, opts)
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "Error reading file")
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if opts.Progress != nil {
+		r = NewProgressReader(r, path, hdr.size, opts.Progress)
+	}
+
+	return c.sendFile(hdr, r)
+}
+
+// sendDir sends a local directory and its contents.
+func (c *conn) sendDir(path string, hdr *header, opts Options) error {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return errors.Wrap(err, "Error reading directory")
+	}
+
+	if err = c.startDir(hdr); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err = c.sendPath(filepath.Join(path, entry.Name()), opts); err != nil {
+			return err
+		}
+	}
+
+	return c.endDir()
+}
+
+// startDir sends a "D" record, entering a directory on the remote.
+func (c *conn) startDir(hdr *header) error {
+	if err := c.sendTimes(hdr); err != nil {
+		return err
+	}
+	return c.writeRecord(dirRecord(hdr))
+}
+
+// endDir sends an "E" record, leaving the current directory on the remote.
+func (c *conn) endDir() error {
+	return c.writeRecord("E\n")
+}
+
+func (c *conn) sendTimes(hdr *header) error {
+	if hdr.mtime.IsZero() {
+		return nil
+	}
+	return c.writeRecord(timeRecord(hdr))
+}
+
+// receive receives a single file from the remote, which must be running
+// "scp -f", writing its contents to w. If fn is set, it's called as the file is
+// received.
+func (c *conn) receive(w io.Writer, fn ProgressFunc) (*header, error) {
+	var received *header
+
+	err := c.receiveAll(func(path string, hdr *header, r io.Reader) error {
+		if received != nil {
+			return &ProtocolError{Message: "received more than one file"}
+		}
+		if r == nil {
+			return &ProtocolError{Message: path + " is a directory"}
+		}
+
+		received = hdr
+		if fn != nil {
+			r = NewProgressReader(r, path, hdr.size, fn)
+		}
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if received == nil {
+		return nil, &ProtocolError{Message: "remote closed the connection before sending a file"}
+	}
+
+	return received, nil
+}
+
+// receiveFunc is called with each file or directory received. path is
+// relative to the destination and uses forward slashes. For files, r reads the
+// file's contents. For directories, r is nil.
+type receiveFunc func(path string, hdr *header, r io.Reader) error
+
+// receiveAll receives files and directories from the remote, which must be
+// running "scp -f", until it closes the connection.
+func (c *conn) receiveAll(fn receiveFunc) error {
+	if err := c.ack(); err != nil {
+		return err
+	}
+
+	var dirs []string
+	hdr := new(header)
+
+	for {
+		typ, line, err := c.readRecord()
+		if err == io.EOF {
+			if len(dirs) > 0 {
+				return &ProtocolError{Message: "remote closed the connection inside a directory"}
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch typ {
+		case 'T':
+			err = parseTimeRecord(line, hdr)
+		case 'C':
+			if err = parseFileRecord(line, hdr); err == nil {
+				err = c.receiveContents(path.Join(append(dirs, hdr.name)...), hdr, fn)
+				hdr = new(header)
+			}
+		case 'D':
+			if err = parseFileRecord(line, hdr); err == nil {
+				dirs = append(dirs, hdr.name)
+				hdr.mode |= os.ModeDir
+				err = fn(path.Join(dirs...), hdr, nil)
+				hdr = new(header)
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				err = &ProtocolError{Message: "unexpected end of directory"}
+			} else {
+				dirs = dirs[:len(dirs)-1]
+			}
+		default:
+			err = &ProtocolError{Message: fmt.Sprintf("unexpected record %s", strconv.QuoteToASCII(string(typ)+line))}
+		}
+
+		if err != nil {
+			c.fail(err.Error())
+			return err
+		}
+
+		// Contents are acknowledged by receiveContents.
+		if typ != 'C' {
+			if err = c.ack(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receiveContents receives the contents of a file after its "C" record,
+// passing them to fn.
+func (c *conn) receiveContents(path string, hdr *header, fn receiveFunc) error {
+	if err := c.ack(); err != nil {
+		return err
+	}
+
+	debug("Reading file")
+	contents := &io.LimitedReader{R: c.r, N: hdr.size}
+	if err := fn(path, hdr, contents); err != nil {
+		return err
+	}
+
+	// Discard anything the callback didn't read.
+	if _, err := io.Copy(ioutil.Discard, contents); err != nil {
+		return errors.Wrap(err, "Error reading file from stdout")
+	}
+	if contents.N > 0 {
+		return &ProtocolError{Message: fmt.Sprintf("read %d bytes of %d byte file", hdr.size-contents.N, hdr.size)}
+	}
+	debugf("Read %d bytes", hdr.size)
+
+	// The remote says whether it read the file successfully.
+	if err := c.readAck(); err != nil {
+		return err
+	}
+
+	return c.ack()
+}
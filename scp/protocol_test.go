@@ -0,0 +1,177 @@
+package scp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceive(t *testing.T) {
+	stdin := bytes.NewBuffer(nil)
+	stdout := strings.NewReader("T1490000000 0 1490000001 0\nC0600 5 server.pem\nhello\x00")
+
+	file := bytes.NewBuffer(nil)
+	hdr, err := newConn(stdin, stdout).receive(file, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "hello", file.String())
+		assert.Equal(t, os.FileMode(0600), hdr.mode)
+		assert.Equal(t, int64(5), hdr.size)
+		assert.Equal(t, "server.pem", hdr.name)
+		assert.Equal(t, time.Unix(1490000000, 0), hdr.mtime)
+		assert.Equal(t, time.Unix(1490000001, 0), hdr.atime)
+		assert.Equal(t, "\x00\x00\x00\x00", stdin.String())
+	}
+}
+
+func TestReceiveErrors(t *testing.T) {
+	_, err := newConn(bytes.NewBuffer(nil), strings.NewReader("\x01scp: foo: No such file or directory\n")).receive(bytes.NewBuffer(nil), nil)
+	if assert.IsType(t, &RemoteError{}, err) {
+		assert.Equal(t, "scp: foo: No such file or directory", err.(*RemoteError).Message)
+		assert.False(t, err.(*RemoteError).Fatal)
+	}
+
+	// Truncated file.
+	_, err = newConn(bytes.NewBuffer(nil), strings.NewReader("C0644 10 foo\nhello")).receive(bytes.NewBuffer(nil), nil)
+	assert.IsType(t, &ProtocolError{}, err)
+
+	// Error after the file contents.
+	_, err = newConn(bytes.NewBuffer(nil), strings.NewReader("C0644 5 foo\nhello\x02read error\n")).receive(bytes.NewBuffer(nil), nil)
+	if assert.IsType(t, &RemoteError{}, err) {
+		assert.True(t, err.(*RemoteError).Fatal)
+	}
+
+	for _, record := range []string{"C0644 5\n", "Cxyz 5 foo\n", "C0644 -1 foo\n", "C0644 5 ../foo\n", "T1 2\n", "X\n"} {
+		stdin := bytes.NewBuffer(nil)
+		_, err = newConn(stdin, strings.NewReader(record)).receive(bytes.NewBuffer(nil), nil)
+		assert.IsType(t, &ProtocolError{}, err, record)
+		assert.Contains(t, stdin.String(), "\x02", record)
+	}
+
+	_, err = newConn(bytes.NewBuffer(nil), strings.NewReader("")).receive(bytes.NewBuffer(nil), nil)
+	assert.IsType(t, &ProtocolError{}, err)
+}
+
+func TestSend(t *testing.T) {
+	stdin := bytes.NewBuffer(nil)
+	stdout := strings.NewReader("\x00\x00\x00")
+
+	hdr := &header{mode: 0644, size: 5, name: "client.pem"}
+	if assert.Nil(t, newConn(stdin, stdout).send(hdr, strings.NewReader("hello"))) {
+		assert.Equal(t, "C0644 5 client.pem\nhello\x00", stdin.String())
+	}
+
+	stdin.Reset()
+	stdout = strings.NewReader("\x00\x00\x00\x00")
+
+	hdr.mtime = time.Unix(1490000000, 5000)
+	hdr.atime = time.Unix(1490000001, 0)
+	if assert.Nil(t, newConn(stdin, stdout).send(hdr, strings.NewReader("hello"))) {
+		assert.Equal(t, "T1490000000 5 1490000001 0\nC0644 5 client.pem\nhello\x00", stdin.String())
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	hdr := &header{mode: 0644, size: 5, name: "client.pem"}
+
+	err := newConn(bytes.NewBuffer(nil), strings.NewReader("\x00\x02scp: client.pem: Permission denied\n")).send(hdr, strings.NewReader("hello"))
+	if assert.IsType(t, &RemoteError{}, err) {
+		assert.Equal(t, "scp: client.pem: Permission denied", err.(*RemoteError).Message)
+	}
+
+	err = newConn(bytes.NewBuffer(nil), strings.NewReader("\x00\x00")).send(hdr, strings.NewReader("hi"))
+	assert.NotNil(t, err)
+
+	err = newConn(bytes.NewBuffer(nil), strings.NewReader("?")).send(hdr, strings.NewReader("hello"))
+	assert.IsType(t, &ProtocolError{}, err)
+}
+
+func TestReceiveAll(t *testing.T) {
+	stdin := bytes.NewBuffer(nil)
+	stdout := strings.NewReader("C0644 5 server.pem\nhello\x00D0755 0 logs\nC0600 3 a.log\nabc\x00D0700 0 old\nC0600 0 b.log\n\x00E\nE\n")
+
+	var paths []string
+	var contents []string
+
+	err := newConn(stdin, stdout).receiveAll(func(path string, hdr *header, r io.Reader) error {
+		paths = append(paths, path)
+		if r == nil {
+			assert.True(t, hdr.mode.IsDir(), path)
+			return nil
+		}
+
+		// Unread contents are discarded.
+		if path == "logs/a.log" {
+			return nil
+		}
+
+		data, err := ioutil.ReadAll(r)
+		contents = append(contents, string(data))
+		return err
+	})
+
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"server.pem", "logs", "logs/a.log", "logs/old", "logs/old/b.log"}, paths)
+		assert.Equal(t, []string{"hello", ""}, contents)
+		assert.Equal(t, strings.Repeat("\x00", 11), stdin.String())
+	}
+
+	for _, records := range []string{"E\n", "D0755 0 logs\n", "D0755 0 ..\n"} {
+		err = newConn(bytes.NewBuffer(nil), strings.NewReader(records)).receiveAll(func(string, *header, io.Reader) error { return nil })
+		assert.IsType(t, &ProtocolError{}, err, records)
+	}
+
+	_, err = newConn(bytes.NewBuffer(nil), strings.NewReader("C0644 1 a\na\x00C0644 1 b\nb\x00")).receive(bytes.NewBuffer(nil), nil)
+	assert.IsType(t, &ProtocolError{}, err)
+
+	_, err = newConn(bytes.NewBuffer(nil), strings.NewReader("D0755 0 logs\nE\n")).receive(bytes.NewBuffer(nil), nil)
+	assert.IsType(t, &ProtocolError{}, err)
+}
+
+func TestSendPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "certs", "empty"), 0750)
+	ioutil.WriteFile(filepath.Join(dir, "certs", "a.pem"), []byte("abc"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "certs", "b.pem"), []byte("de"), 0644)
+	os.Chmod(filepath.Join(dir, "certs"), 0750)
+
+	stdin := bytes.NewBuffer(nil)
+	stdout := strings.NewReader(strings.Repeat("\x00", 8))
+
+	if assert.Nil(t, newConn(stdin, stdout).sendPath(filepath.Join(dir, "certs"), Options{Recursive: true})) {
+		assert.Equal(t, "D0750 0 certs\nC0600 3 a.pem\nabc\x00C0644 2 b.pem\nde\x00D0750 0 empty\nE\nE\n", stdin.String())
+	}
+
+	err = newConn(bytes.NewBuffer(nil), strings.NewReader("")).sendPath(filepath.Join(dir, "certs"), Options{})
+	assert.NotNil(t, err)
+}
+
+func TestSendPathPreserve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.pem")
+	ioutil.WriteFile(path, []byte("abc"), 0600)
+	os.Chtimes(path, time.Unix(1490000000, 0), time.Unix(1490000000, 0))
+
+	stdin := bytes.NewBuffer(nil)
+	stdout := strings.NewReader(strings.Repeat("\x00", 3))
+
+	if assert.Nil(t, newConn(stdin, stdout).sendPath(path, Options{Preserve: true})) {
+		assert.Equal(t, "T1490000000 0 1490000000 0\nC0600 3 a.pem\nabc\x00", stdin.String())
+	}
+}
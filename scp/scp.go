@@ -1,11 +1,14 @@
 package scp
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"log"
-	"strconv"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
@@ -16,7 +19,21 @@ var Debug bool
 
 // PutFile writes a file on the remote server.
 func PutFile(session *ssh.Session, path string, file []byte) error {
-	debugf("PutFile: %s\n", path)
+	return Put(session, path, int64(len(file)), 0644, bytes.NewReader(file))
+}
+
+// Put streams size bytes from r to a file on the remote server, creating it
+// with the given mode. Errors reported by the remote are returned as
+// *RemoteError.
+func Put(session *ssh.Session, path string, size int64, mode os.FileMode, r io.Reader) error {
+	return PutWithInfo(session, path, &FileInfo{Mode: mode, Size: size}, r)
+}
+
+// PutWithInfo streams info.Size bytes from r to a file on the remote server,
+// creating it with info.Mode. If info.ModTime is set, the file's mode and
+// times are preserved, like "scp -p". info.Path is ignored.
+func PutWithInfo(session *ssh.Session, path string, info *FileInfo, r io.Reader) error {
+	debugf("Put: %s\n", path)
 
 	stdin, stdout, err := openPipes(session)
 	if err != nil {
@@ -24,124 +41,274 @@ func PutFile(session *ssh.Session, path string, file []byte) error {
 	}
 	defer stdin.Close()
 
-	cmd := "scp -t " + path
+	cmd := "scp -t "
+	if !info.ModTime.IsZero() {
+		cmd += "-p "
+	}
+	cmd += path
+
 	debugf("Running command: '%s'\n", cmd)
 	if err = session.Start(cmd); err != nil {
 		return errors.Wrap(err, fmt.Sprintf("Error starting command '%s'", cmd))
 	}
 
-	return putFile(stdin, stdout, path, file)
+	return newConn(stdin, stdout).send(info.header(filepath.Base(path)), r)
 }
 
-func putFile(stdin io.WriteCloser, stdout io.Reader, path string, file []byte) error {
-	debug("Reading bytes")
-	buf := make([]byte, 1024)
-	n, err := stdout.Read(buf)
-	if err != nil {
-		return errors.Wrap(err, "Error reading bytes from stdout")
+// GetFile get's a file from the remote server.
+func GetFile(session *ssh.Session, path string) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if _, err := Get(session, path, buf); err != nil {
+		return nil, err
 	}
-	debug("Read bytes: ", buf[:n])
+	return buf.Bytes(), nil
+}
 
-	// Eg. "C0644 1192 server.pem"
-	hdr := fmt.Sprintf("C0644 %d %s\n", len(file), path)
-	debugf("Writing file header to stdin: %s", strconv.QuoteToASCII(hdr))
-	if _, err = stdin.Write([]byte(hdr)); err != nil {
-		return errors.Wrap(err, "Error writing metadata to stdin")
+// Get streams a file from the remote server to w, returning its mode, size and
+// times. Errors reported by the remote are returned as *RemoteError.
+func Get(session *ssh.Session, path string, w io.Writer) (*FileInfo, error) {
+	return GetWithProgress(session, path, w, nil)
+}
+
+// GetWithProgress is like Get, but calls fn, if set, as the file is received.
+func GetWithProgress(session *ssh.Session, path string, w io.Writer, fn ProgressFunc) (*FileInfo, error) {
+	debugf("Get: %s\n", path)
+
+	stdin, stdout, err := openPipes(session)
+	if err != nil {
+		return nil, err
 	}
-	debug("Wrote header")
+	defer stdin.Close()
 
-	debug("Writing file")
-	if _, err = stdin.Write(file); err != nil {
-		return errors.Wrap(err, "Error writing file to stdin")
+	// -p has the remote send the file's times.
+	cmd := "scp -f -p " + path
+	debugf("Running command: '%s'\n", cmd)
+	if err = session.Start(cmd); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error starting command '%s'", cmd))
 	}
-	debug("Wrote file")
 
-	debug("Reading bytes")
-	n, err = stdout.Read(buf)
+	hdr, err := newConn(stdin, stdout).receive(w, fn)
 	if err != nil {
-		return errors.Wrap(err, "Error reading bytes from stdout")
+		return nil, err
 	}
-	debug("Read bytes: ", buf[:n])
 
-	debug("Writing reply")
-	if _, err = stdin.Write([]byte{0x00}); err != nil {
-		return errors.Wrap(err, "Error writing reply to stdin")
+	return hdr.fileInfo(hdr.name), nil
+}
+
+// FileInfo describes a file or directory sent or received.
+type FileInfo struct {
+	// Path is relative to the destination and uses forward slashes.
+	Path string
+	Mode os.FileMode
+	Size int64
+
+	// ModTime and AccessTime are only set if times were sent.
+	ModTime    time.Time
+	AccessTime time.Time
+}
+
+// header returns the protocol header for sending the file with the given
+// name.
+func (info *FileInfo) header(name string) *header {
+	hdr := &header{mode: info.Mode, size: info.Size, name: name}
+
+	if !info.ModTime.IsZero() {
+		hdr.mtime, hdr.atime = info.ModTime, info.AccessTime
+		if hdr.atime.IsZero() {
+			hdr.atime = hdr.mtime
+		}
 	}
-	debug("Wrote reply")
 
-	debug("Reading bytes")
-	n, err = stdout.Read(buf)
-	if err != nil {
-		return errors.Wrap(err, "Error reading bytes from stdout")
+	return hdr
+}
+
+// fileInfo returns the FileInfo for a received header.
+func (hdr *header) fileInfo(path string) *FileInfo {
+	return &FileInfo{
+		Path:       path,
+		Mode:       hdr.mode,
+		Size:       hdr.size,
+		ModTime:    hdr.mtime,
+		AccessTime: hdr.atime,
 	}
-	debug("Read bytes: ", buf[:n])
+}
 
-	return nil
+// Options control multi-file transfers.
+type Options struct {
+	// Recursive copies directories along with their contents.
+	Recursive bool
+
+	// Preserve keeps files' modes and modification and access times, like
+	// "scp -p". Go can't portably read access times, so local files are
+	// uploaded with their modification time as their access time.
+	Preserve bool
+
+	// Progress, if set, is called as each file is transferred.
+	Progress ProgressFunc
 }
 
-// GetFile get's a file from the remote server.
-func GetFile(session *ssh.Session, path string) ([]byte, error) {
-	debugf("GetFile: %s\n", path)
+// flags returns the scp flags for the options.
+func (opts Options) flags() string {
+	var flags string
+	if opts.Recursive {
+		flags += "-r "
+	}
+	if opts.Preserve {
+		flags += "-p "
+	}
+	return flags
+}
+
+// ReceiveFunc is called by GetAll for each file or directory received. For
+// files, r reads the file's contents. For directories, r is nil and the
+// directory's contents follow.
+type ReceiveFunc func(info *FileInfo, r io.Reader) error
+
+// GetAll gets several files from the remote server in a single session,
+// calling fn for each. Glob patterns in paths are expanded by the remote.
+func GetAll(session *ssh.Session, paths []string, opts Options, fn ReceiveFunc) error {
+	debugf("GetAll: %v\n", paths)
 
 	stdin, stdout, err := openPipes(session)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer stdin.Close()
 
-	cmd := "scp -f " + path
+	cmd := "scp -f " + opts.flags() + strings.Join(paths, " ")
 	debugf("Running command: '%s'\n", cmd)
 	if err = session.Start(cmd); err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("Error starting command '%s'", cmd))
+		return errors.Wrap(err, fmt.Sprintf("Error starting command '%s'", cmd))
 	}
 
-	return getFile(stdin, stdout)
+	return newConn(stdin, stdout).receiveAll(func(path string, hdr *header, r io.Reader) error {
+		if r != nil && opts.Progress != nil {
+			r = NewProgressReader(r, path, hdr.size, opts.Progress)
+		}
+		return fn(hdr.fileInfo(path), r)
+	})
 }
 
-func getFile(stdin io.WriteCloser, stdout io.Reader) ([]byte, error) {
-	debug("Writing null byte")
-	stdin.Write([]byte{0x00})
+// GetToDir gets several files from the remote server in a single session,
+// writing them into the local directory dir.
+func GetToDir(session *ssh.Session, paths []string, dir string, opts Options) error {
+	return ReceiveToDir(dir, opts.Preserve, func(fn ReceiveFunc) error {
+		return GetAll(session, paths, opts, fn)
+	})
+}
+
+// ReceiveToDir writes the files and directories that receive passes to its
+// ReceiveFunc into the local directory dir. If preserve is set, their modes and
+// times are kept. It lets other transfer protocols share GetToDir's handling of
+// local files.
+func ReceiveToDir(dir string, preserve bool, receive func(ReceiveFunc) error) error {
+	var dirs []*FileInfo
 
-	debug("Reading file header")
-	hdr := make([]byte, 1024)
-	n, err := stdout.Read(hdr)
+	err := receive(func(info *FileInfo, r io.Reader) error {
+		if r == nil {
+			dirs = append(dirs, info)
+		}
+		return writeLocal(dir, info, r, preserve)
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "Error reading header from stdin")
+		return err
 	}
-	debugf("Got header: '%s'", strconv.QuoteToASCII(string(hdr[:n])))
 
-	// Parse file length from header
-	// Eg.
-	//   C0644 1192 server.pem
-	//   mode| size| path
-	hparts := strings.SplitN(string(hdr[:n]), " ", 3)
-	if hparts == nil || len(hparts) != 3 {
-		return nil, errors.New("Bad header from SCP")
+	if !preserve {
+		return nil
+	}
+
+	// Writing a directory's contents changes its times, so they're set last,
+	// innermost first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = setTimes(filepath.Join(dir, filepath.FromSlash(dirs[i].Path)), dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeLocal writes a received file or directory beneath dir.
+func writeLocal(dir string, info *FileInfo, r io.Reader, preserve bool) error {
+	path := filepath.Join(dir, filepath.FromSlash(info.Path))
+
+	if r == nil {
+		// We need to be able to write the directory's contents.
+		if err := os.MkdirAll(path, info.Mode.Perm()|0700); err != nil {
+			return errors.Wrap(err, "Error creating directory")
+		}
+		return nil
 	}
 
-	flen, err := strconv.ParseInt(hparts[1], 10, 64)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode.Perm())
 	if err != nil {
-		return nil, errors.Wrap(err, "Error parsing SCP metadata")
+		return errors.Wrap(err, "Error creating file")
 	}
 
-	debug("Writing null byte")
-	stdin.Write([]byte{0x00})
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		return errors.Wrap(err, fmt.Sprintf("Error writing %s", path))
+	}
+
+	if err = file.Close(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error writing %s", path))
+	}
 
-	debug("Reading file")
-	file := make([]byte, flen)
-	n, err = stdout.Read(file)
+	if !preserve {
+		return nil
+	}
+
+	// The file's mode may have been masked by the umask when it was created,
+	// or it may have already existed.
+	if err = os.Chmod(path, info.Mode.Perm()); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error setting mode of %s", path))
+	}
+
+	return setTimes(path, info)
+}
+
+func setTimes(path string, info *FileInfo) error {
+	if info.ModTime.IsZero() {
+		return nil
+	}
+
+	if err := os.Chtimes(path, info.AccessTime, info.ModTime); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error setting times of %s", path))
+	}
+
+	return nil
+}
+
+// PutAll uploads several local files into the directory dir on the remote
+// server in a single session.
+func PutAll(session *ssh.Session, paths []string, dir string, opts Options) error {
+	debugf("PutAll: %v -> %s\n", paths, dir)
+
+	stdin, stdout, err := openPipes(session)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error reading from stdin")
+		return err
 	}
-	if n != int(flen) {
-		return nil, errors.New("Read incomplete file")
+	defer stdin.Close()
+
+	cmd := "scp -t -d " + opts.flags() + dir
+	debugf("Running command: '%s'\n", cmd)
+	if err = session.Start(cmd); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error starting command '%s'", cmd))
 	}
-	debug("File: ", string(file))
 
-	debug("Writing null byte")
-	stdin.Write([]byte{0x00})
+	c := newConn(stdin, stdout)
+	if err = c.readAck(); err != nil {
+		return err
+	}
 
-	return file, nil
+	for _, path := range paths {
+		if err = c.sendPath(path, opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func openPipes(session *ssh.Session) (stdin io.WriteCloser, stdout io.Reader, err error) {
@@ -0,0 +1,55 @@
+package scp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(1490000000, 0)
+	atime := time.Unix(1490000001, 0)
+
+	assert.Nil(t, writeLocal(dir, &FileInfo{Path: "logs", Mode: 0500 | os.ModeDir}, nil, true))
+
+	info := &FileInfo{Path: "logs/a.log", Mode: 0666, Size: 3, ModTime: mtime, AccessTime: atime}
+	if assert.Nil(t, writeLocal(dir, info, strings.NewReader("abc"), true)) {
+		stat, err := os.Stat(filepath.Join(dir, "logs", "a.log"))
+		if assert.Nil(t, err) {
+			assert.Equal(t, os.FileMode(0666), stat.Mode().Perm())
+			assert.True(t, mtime.Equal(stat.ModTime()))
+		}
+	}
+
+	// The directory is writable until its contents have been written.
+	stat, err := os.Stat(filepath.Join(dir, "logs"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+	}
+}
+
+func TestFileInfoHeader(t *testing.T) {
+	mtime := time.Unix(1490000000, 0)
+
+	hdr := (&FileInfo{Path: "ignored", Mode: 0600, Size: 5, ModTime: mtime}).header("client.pem")
+	assert.Equal(t, "T1490000000 0 1490000000 0\n", timeRecord(hdr))
+	assert.Equal(t, "C0600 5 client.pem\n", fileRecord(hdr))
+
+	hdr = (&FileInfo{Mode: 0644, Size: 5}).header("client.pem")
+	assert.True(t, hdr.mtime.IsZero())
+
+	info := hdr.fileInfo("certs/client.pem")
+	assert.Equal(t, "certs/client.pem", info.Path)
+	assert.Equal(t, int64(5), info.Size)
+}
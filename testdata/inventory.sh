@@ -0,0 +1,26 @@
+#!/bin/sh
+# A dynamic inventory for tests. Prints the number of times it's been run to
+# $LUNASH_TEST_INVENTORY_COUNT, if set.
+if [ "$1" = "--env" ]; then
+  env="$2"
+  shift 2
+fi
+
+if [ "$1" != "--list" ]; then
+  echo "usage: $0 [--env ENV] --list" >&2
+  exit 1
+fi
+
+if [ -n "$LUNASH_TEST_INVENTORY_COUNT" ]; then
+  echo x >> "$LUNASH_TEST_INVENTORY_COUNT"
+fi
+
+cat <<JSON
+{
+  "defaults": {"ssh_login": "cmdb"},
+  "hsms": [
+    {"nickname": "hsm1", "hostname": "1.1.1.1", "ssh_password": "from_cmdb"},
+    {"nickname": "$env-hsm4", "hostname": "4.4.4.4", "ssh_fingerprint": "SHA256:40QvIN7FAGgYxl+5UVoTskPK1zKswZcDzPCK6aZReuU"}
+  ]
+}
+JSON
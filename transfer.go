@@ -0,0 +1,366 @@
+package lunash
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mastahyeti/lunash/scp"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Protocols for transferring files to and from HSMs, set by an HSM's
+// "transfer" setting.
+const (
+	TransferSCP  = "scp"
+	TransferSFTP = "sftp"
+)
+
+// transport transfers files to and from the HSM. Its methods back the Client's
+// Scp methods.
+type transport interface {
+	get(path string, w io.Writer, fn scp.ProgressFunc) (*scp.FileInfo, error)
+	put(path string, info *scp.FileInfo, r io.Reader) error
+	getFiles(paths []string, dir string, opts scp.Options) error
+	putFiles(paths []string, dir string, opts scp.Options) error
+	close() error
+}
+
+// transport returns the transport for the HSM's transfer setting. If SFTP is
+// requested but the HSM refuses the subsystem, SCP is used instead.
+func (c *Client) transport() transport {
+	if c.xfer != nil {
+		return c.xfer
+	}
+
+	c.xfer = &scpTransport{client: c}
+
+	if c.config.Transfer == TransferSFTP {
+		client, err := sftp.NewClient(c.client)
+		if err == nil {
+			c.xfer = &sftpTransport{client: client}
+		} else {
+			log.Printf("SFTP isn't available on %s, falling back to SCP: %s", c.config.Name(), err)
+		}
+	}
+
+	return c.xfer
+}
+
+// scpTransport transfers files with the scp package.
+type scpTransport struct {
+	client *Client
+}
+
+// withSession runs fn in a new session, returning its error or any error from
+// the session.
+func (t *scpTransport) withSession(fn func(*ssh.Session) error) error {
+	var scpErr error
+
+	sesErr := t.client.WithSession(func(session *ssh.Session) {
+		scpErr = fn(session)
+	})
+
+	if scpErr != nil {
+		return scpErr
+	}
+	return sesErr
+}
+
+func (t *scpTransport) get(path string, w io.Writer, fn scp.ProgressFunc) (info *scp.FileInfo, err error) {
+	err = t.withSession(func(session *ssh.Session) (serr error) {
+		info, serr = scp.GetWithProgress(session, path, w, fn)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (t *scpTransport) put(path string, info *scp.FileInfo, r io.Reader) error {
+	return t.withSession(func(session *ssh.Session) error {
+		return scp.PutWithInfo(session, path, info, r)
+	})
+}
+
+func (t *scpTransport) getFiles(paths []string, dir string, opts scp.Options) error {
+	return t.withSession(func(session *ssh.Session) error {
+		return scp.GetToDir(session, paths, dir, opts)
+	})
+}
+
+func (t *scpTransport) putFiles(paths []string, dir string, opts scp.Options) error {
+	return t.withSession(func(session *ssh.Session) error {
+		return scp.PutAll(session, paths, dir, opts)
+	})
+}
+
+func (t *scpTransport) close() error {
+	return nil
+}
+
+// sftpTransport transfers files over the SFTP subsystem.
+type sftpTransport struct {
+	client *sftp.Client
+}
+
+func (t *sftpTransport) get(path string, w io.Writer, fn scp.ProgressFunc) (*scp.FileInfo, error) {
+	file, err := t.client.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error opening %s over SFTP", path))
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error reading %s over SFTP", path))
+	}
+	if stat.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	info := sftpFileInfo(path, stat)
+
+	var r io.Reader = file
+	if fn != nil {
+		r = scp.NewProgressReader(r, path, info.Size, fn)
+	}
+
+	if _, err = io.Copy(w, r); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error reading %s over SFTP", path))
+	}
+
+	return info, nil
+}
+
+func (t *sftpTransport) put(path string, info *scp.FileInfo, r io.Reader) error {
+	file, err := t.client.Create(path)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error creating %s over SFTP", path))
+	}
+
+	n, err := io.CopyN(file, r, info.Size)
+	if err == io.EOF {
+		err = fmt.Errorf("File is %d bytes, but %d bytes were expected", n, info.Size)
+	}
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, fmt.Sprintf("Error writing %s over SFTP", path))
+	}
+
+	if err = file.Close(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error writing %s over SFTP", path))
+	}
+
+	return t.setAttrs(path, info)
+}
+
+// setAttrs sets a remote file's mode, and its times if they're set.
+func (t *sftpTransport) setAttrs(path string, info *scp.FileInfo) error {
+	if err := t.client.Chmod(path, info.Mode.Perm()); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error setting mode of %s over SFTP", path))
+	}
+
+	if info.ModTime.IsZero() {
+		return nil
+	}
+
+	atime := info.AccessTime
+	if atime.IsZero() {
+		atime = info.ModTime
+	}
+
+	if err := t.client.Chtimes(path, atime, info.ModTime); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error setting times of %s over SFTP", path))
+	}
+
+	return nil
+}
+
+func (t *sftpTransport) getFiles(paths []string, dir string, opts scp.Options) error {
+	return scp.ReceiveToDir(dir, opts.Preserve, func(fn scp.ReceiveFunc) error {
+		for _, pattern := range paths {
+			matches, err := t.glob(pattern)
+			if err != nil {
+				return err
+			}
+
+			for _, match := range matches {
+				if err = t.getPath(match, path.Base(match), opts, fn); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// getPath passes a remote file, or a directory and its contents, to fn as
+// rel.
+func (t *sftpTransport) getPath(remote, rel string, opts scp.Options, fn scp.ReceiveFunc) error {
+	stat, err := t.client.Stat(remote)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error reading %s over SFTP", remote))
+	}
+
+	info := sftpFileInfo(rel, stat)
+	if !opts.Preserve {
+		info.ModTime, info.AccessTime = time.Time{}, time.Time{}
+	}
+
+	if stat.IsDir() {
+		if !opts.Recursive {
+			return fmt.Errorf("%s is a directory", remote)
+		}
+
+		if err = fn(info, nil); err != nil {
+			return err
+		}
+
+		entries, err := t.client.ReadDir(remote)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Error reading directory %s over SFTP", remote))
+		}
+
+		for _, entry := range entries {
+			if err = t.getPath(path.Join(remote, entry.Name()), path.Join(rel, entry.Name()), opts, fn); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	file, err := t.client.Open(remote)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error opening %s over SFTP", remote))
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if opts.Progress != nil {
+		r = scp.NewProgressReader(r, rel, info.Size, opts.Progress)
+	}
+
+	return fn(info, r)
+}
+
+// glob expands glob patterns in a remote path, like the remote shell does for
+// SCP.
+func (t *sftpTransport) glob(pattern string) ([]string, error) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+
+	matches, err := t.client.Glob(pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error expanding %s over SFTP", pattern))
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("No files match %s", pattern)
+	}
+
+	return matches, nil
+}
+
+func (t *sftpTransport) putFiles(paths []string, dir string, opts scp.Options) error {
+	for _, local := range paths {
+		if err := t.putPath(local, path.Join(dir, filepath.Base(local)), opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putPath uploads a local file, or a directory and its contents, to remote.
+func (t *sftpTransport) putPath(local, remote string, opts scp.Options) error {
+	stat, err := os.Stat(local)
+	if err != nil {
+		return errors.Wrap(err, "Error reading file")
+	}
+
+	info := &scp.FileInfo{Mode: stat.Mode().Perm(), Size: stat.Size()}
+	if opts.Preserve {
+		info.ModTime = stat.ModTime()
+	}
+
+	if stat.IsDir() {
+		if !opts.Recursive {
+			return fmt.Errorf("%s is a directory", local)
+		}
+
+		if _, err = t.client.Stat(remote); err != nil {
+			if err = t.client.Mkdir(remote); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Error creating directory %s over SFTP", remote))
+			}
+		}
+
+		entries, err := ioutil.ReadDir(local)
+		if err != nil {
+			return errors.Wrap(err, "Error reading directory")
+		}
+
+		for _, entry := range entries {
+			if err = t.putPath(filepath.Join(local, entry.Name()), path.Join(remote, entry.Name()), opts); err != nil {
+				return err
+			}
+		}
+
+		// Writing the directory's contents changes its times, so they're set
+		// last.
+		return t.setAttrs(remote, info)
+	}
+
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", local)
+	}
+
+	file, err := os.Open(local)
+	if err != nil {
+		return errors.Wrap(err, "Error reading file")
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if opts.Progress != nil {
+		r = scp.NewProgressReader(r, local, info.Size, opts.Progress)
+	}
+
+	return t.put(remote, info, r)
+}
+
+func (t *sftpTransport) close() error {
+	return t.client.Close()
+}
+
+// sftpFileInfo converts the attributes of the remote file at path.
+func sftpFileInfo(path string, stat os.FileInfo) *scp.FileInfo {
+	info := &scp.FileInfo{
+		Path:    path,
+		Mode:    stat.Mode().Perm(),
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+	}
+
+	if stat.IsDir() {
+		info.Mode |= os.ModeDir
+		info.Size = 0
+	}
+
+	info.AccessTime = info.ModTime
+	if fs, ok := stat.Sys().(*sftp.FileStat); ok {
+		info.AccessTime = time.Unix(int64(fs.Atime), 0)
+	}
+
+	return info
+}
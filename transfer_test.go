@@ -0,0 +1,321 @@
+package lunash
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/mastahyeti/lunash/scp"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// pipeConn joins two pipes into an io.ReadWriteCloser.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// testSFTPTransport returns an sftpTransport connected to an in-process SFTP
+// server for the local filesystem.
+func testSFTPTransport(t *testing.T) (*sftpTransport, func()) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	server, err := sftp.NewServer(pipeConn{sr, sw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// The client waits for the server to hang up when it's closed.
+		server.Serve()
+		sw.Close()
+	}()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &sftpTransport{client: client}, func() { client.Close() }
+}
+
+func TestSFTPTransport(t *testing.T) {
+	xfer, done := testSFTPTransport(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "lunash")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(1490000000, 0)
+	remote := filepath.Join(dir, "server.pem")
+
+	info := &scp.FileInfo{Mode: 0600, Size: 5, ModTime: mtime}
+	if !assert.Nil(t, xfer.put(remote, info, bytes.NewReader([]byte("hello")))) {
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	got, err := xfer.get(remote, buf, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "hello", buf.String())
+		assert.Equal(t, os.FileMode(0600), got.Mode)
+		assert.Equal(t, int64(5), got.Size)
+		assert.True(t, mtime.Equal(got.ModTime))
+	}
+
+	// Short reads are errors.
+	assert.NotNil(t, xfer.put(remote, &scp.FileInfo{Mode: 0644, Size: 10}, bytes.NewReader([]byte("hello"))))
+
+	local := filepath.Join(dir, "local")
+	os.MkdirAll(filepath.Join(local, "certs"), 0700)
+	ioutil.WriteFile(filepath.Join(local, "certs", "a.pem"), []byte("abc"), 0644)
+
+	remoteDir := filepath.Join(dir, "remote")
+	os.Mkdir(remoteDir, 0700)
+
+	if !assert.Nil(t, xfer.putFiles([]string{filepath.Join(local, "certs")}, remoteDir, scp.Options{Recursive: true})) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(remoteDir, "certs", "a.pem"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "abc", string(data))
+	}
+
+	out := filepath.Join(dir, "out")
+	os.Mkdir(out, 0700)
+
+	err = xfer.getFiles([]string{filepath.Join(remoteDir, "cert*"), remote}, out, scp.Options{Recursive: true})
+	if assert.Nil(t, err) {
+		data, err = ioutil.ReadFile(filepath.Join(out, "certs", "a.pem"))
+		assert.Nil(t, err)
+		assert.Equal(t, "abc", string(data))
+
+		data, err = ioutil.ReadFile(filepath.Join(out, "server.pem"))
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+
+	assert.NotNil(t, xfer.getFiles([]string{filepath.Join(remoteDir, "certs")}, out, scp.Options{}))
+	assert.NotNil(t, xfer.getFiles([]string{filepath.Join(remoteDir, "*.missing")}, out, scp.Options{}))
+}
+
+// testSCPClient returns a Client connected to an in-process SSH server that
+// runs a fake scp, which reads and writes files in the map.
+func testSCPClient(t *testing.T, files map[string][]byte) *Client {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	// Both ends write their version first, so they need a buffered
+	// connection rather than a net.Pipe.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		_, chans, reqs, err := ssh.NewServerConn(serverConn, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		for newChan := range chans {
+			ch, reqs, err := newChan.Accept()
+			if err != nil {
+				return
+			}
+			go serveSCP(ch, reqs, files)
+		}
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a HostKeyCallback, any host key is accepted.
+	conn, chans, reqs, err := ssh.NewClientConn(clientConn, "hsm1", &ssh.ClientConfig{User: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Client{config: &Config{Hostname: "hsm1"}, client: ssh.NewClient(conn, chans, reqs)}
+}
+
+// serveSCP runs the "scp -t" or "scp -f" command of a session.
+func serveSCP(ch ssh.Channel, reqs <-chan *ssh.Request, files map[string][]byte) {
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		var exec struct{ Command string }
+		ssh.Unmarshal(req.Payload, &exec)
+		args := strings.Fields(exec.Command)
+		name := args[len(args)-1]
+
+		var err error
+		if args[1] == "-t" {
+			err = scpSink(ch, bufio.NewReader(ch), name, files)
+		} else {
+			err = scpSource(ch, bufio.NewReader(ch), name, files)
+		}
+
+		var status struct{ Status uint32 }
+		if err != nil {
+			status.Status = 1
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+		return
+	}
+}
+
+// scpSink receives a file like "scp -t".
+func scpSink(w io.Writer, r *bufio.Reader, name string, files map[string][]byte) error {
+	w.Write([]byte{0})
+
+	record, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(record, "T") {
+		w.Write([]byte{0})
+		if record, err = r.ReadString('\n'); err != nil {
+			return err
+		}
+	}
+
+	var mode os.FileMode
+	var size int64
+	var base string
+	if _, err = fmt.Sscanf(record, "C%o %d %s", &mode, &size, &base); err != nil {
+		return err
+	}
+	w.Write([]byte{0})
+
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if _, err = r.ReadByte(); err != nil {
+		return err
+	}
+
+	files[name] = data
+	_, err = w.Write([]byte{0})
+	return err
+}
+
+// scpSource sends a file like "scp -f".
+func scpSource(w io.Writer, r *bufio.Reader, name string, files map[string][]byte) error {
+	if _, err := r.ReadByte(); err != nil {
+		return err
+	}
+
+	data, ok := files[name]
+	if !ok {
+		fmt.Fprintf(w, "\x01scp: %s: No such file or directory\n", name)
+		return os.ErrNotExist
+	}
+
+	fmt.Fprintf(w, "C0600 %d %s\n", len(data), path.Base(name))
+	if _, err := r.ReadByte(); err != nil {
+		return err
+	}
+
+	w.Write(data)
+	w.Write([]byte{0})
+	_, err := r.ReadByte()
+	return err
+}
+
+func TestSCPTransportStreams(t *testing.T) {
+	files := map[string][]byte{}
+	c := testSCPClient(t, files)
+	defer c.Close()
+
+	contents := strings.Repeat("-----BEGIN CERTIFICATE-----\n", 100)
+
+	// Readers that return a byte at a time are streamed in full.
+	err := c.ScpPutFrom("server.pem", int64(len(contents)), 0644, iotest.OneByteReader(strings.NewReader(contents)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, contents, string(files["server.pem"]))
+
+	var got strings.Builder
+	info, err := c.ScpGetTo("server.pem", &got)
+	if assert.Nil(t, err) {
+		assert.Equal(t, contents, got.String())
+		assert.Equal(t, int64(len(contents)), info.Size)
+	}
+
+	var putErr error
+	err = c.WithSession(func(session *ssh.Session) {
+		putErr = scp.Put(session, "client.pem", 5, 0600, iotest.HalfReader(strings.NewReader("hello")))
+	})
+	if assert.Nil(t, err) && assert.Nil(t, putErr) {
+		assert.Equal(t, "hello", string(files["client.pem"]))
+	}
+
+	// The file is read as it's received.
+	pr, pw := io.Pipe()
+	read := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(pr)
+		read <- string(data)
+	}()
+
+	var getErr error
+	err = c.WithSession(func(session *ssh.Session) {
+		_, getErr = scp.Get(session, "client.pem", pw)
+		pw.Close()
+	})
+	if assert.Nil(t, err) && assert.Nil(t, getErr) {
+		assert.Equal(t, "hello", <-read)
+	}
+
+	// Short readers are errors rather than hanging.
+	assert.NotNil(t, c.ScpPutFrom("short.pem", 10, 0644, strings.NewReader("hello")))
+
+	_, err = c.ScpGetTo("missing.pem", &got)
+	assert.IsType(t, &scp.RemoteError{}, err)
+}
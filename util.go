@@ -3,6 +3,9 @@ package lunash
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -45,3 +48,35 @@ func firstLine(str string) (fline, rest string) {
 	rest = strings.Join(lines[1:], "\n")
 	return
 }
+
+// WriteFileAtomic writes data to a temporary file and renames it over path, so
+// readers never see a partially written file.
+func WriteFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "Error creating temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Error writing temporary file")
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Error writing temporary file")
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Error setting file mode")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "Error writing temporary file")
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "Error replacing "+path)
+	}
+
+	return nil
+}
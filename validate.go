@@ -0,0 +1,804 @@
+package lunash
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigProblem is a problem found while validating a config file.
+type ConfigProblem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+// String formats the problem like a compiler diagnostic.
+func (p ConfigProblem) String() string {
+	return fmt.Sprintf("%s: %s", formatLocation(p.File, p.Line), p.Message)
+}
+
+func formatLocation(file string, line int) string {
+	if line > 0 {
+		return fmt.Sprintf("%s:%d", file, line)
+	}
+	return file
+}
+
+// ConfigErrors is returned by LoadAllConfigsStrict when the config has
+// problems.
+type ConfigErrors []ConfigProblem
+
+// Error implements the error interface.
+func (e ConfigErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, p := range e {
+		lines = append(lines, p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// LoadAllConfigsStrict is like LoadAllConfigs, but rejects config files with
+// unknown fields, duplicate names, missing ports or fingerprints and malformed
+// fingerprints. If any problems are found, the error is a ConfigErrors listing
+// all of them.
+func LoadAllConfigsStrict(path string) ([]*Config, error) {
+	path, err := FindConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	loader := newConfigLoader()
+	loader.strict = true
+
+	if err = loader.load(path, nil); err != nil {
+		return nil, err
+	}
+
+	configs, err := loader.configs()
+	if err != nil {
+		return nil, err
+	}
+
+	loader.validate(configs)
+
+	if len(loader.problems) > 0 {
+		return nil, loader.problems
+	}
+
+	return configs, nil
+}
+
+// problem records a problem with a config file.
+func (l *configLoader) problem(file string, line int, format string, args ...interface{}) {
+	l.problems = append(l.problems, ConfigProblem{
+		File:    file,
+		Line:    line,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// check parses a config file keeping track of line numbers and reports
+// structural problems like unknown fields. It reports false if the file can't
+// be parsed at all.
+func (l *configLoader) check(path string, data []byte) bool {
+	root, err := parseConfigNode(data, ConfigFormat(path))
+	if err != nil {
+		line, msg := syntaxErrorLine(data, err)
+		l.problem(path, line, "%s", msg)
+		return false
+	}
+	l.nodes[path] = root
+
+	top := root
+	if root.items != nil {
+		// The legacy format.
+		top = &configNode{line: root.line, fields: map[string]*configNode{"hsms": root}}
+	} else if root.fields == nil {
+		l.problem(path, root.line, "config file must be an array or object")
+		return false
+	}
+
+	for _, key := range top.sortedKeys() {
+		node := top.fields[key]
+
+		switch key {
+		case "defaults":
+			l.checkConfigNode(path, node, "defaults")
+		case "groups":
+			if node.fields == nil {
+				l.problem(path, node.line, "groups must be an object")
+				continue
+			}
+			for _, name := range node.sortedKeys() {
+				l.checkConfigNode(path, node.fields[name], "group "+name)
+			}
+		case "hsms":
+			if node.items == nil {
+				l.problem(path, node.line, "hsms must be an array")
+				continue
+			}
+			for i, item := range node.items {
+				l.checkConfigNode(path, item, fmt.Sprintf("hsm #%d", i+1))
+			}
+		case "include":
+			if node.items == nil {
+				l.problem(path, node.line, "include must be an array")
+			}
+		case "inventory":
+			if node.items == nil {
+				l.problem(path, node.line, "inventory must be an array")
+				continue
+			}
+			for i, item := range node.items {
+				l.checkInventoryNode(path, item, fmt.Sprintf("inventory #%d", i+1))
+			}
+		default:
+			l.problem(path, node.line, "unknown config file key '%s'", key)
+		}
+	}
+
+	return true
+}
+
+// checkConfigNode reports unknown or mistyped fields in a single HSM, group
+// or defaults entry.
+func (l *configLoader) checkConfigNode(path string, node *configNode, what string) {
+	if node.fields == nil {
+		l.problem(path, node.line, "%s must be an object", what)
+		return
+	}
+
+	known := configFields()
+
+	for _, key := range node.sortedKeys() {
+		value := node.fields[key]
+
+		kind, ok := known[key]
+		if !ok {
+			if suggestion := closestField(key); suggestion != "" {
+				l.problem(path, value.line, "unknown field '%s' in %s (did you mean '%s'?)", key, what, suggestion)
+			} else {
+				l.problem(path, value.line, "unknown field '%s' in %s", key, what)
+			}
+			continue
+		}
+
+		if !fieldKindOK(kind, value) {
+			l.problem(path, value.line, "field '%s' in %s must be %s", key, what, kindName(kind))
+		}
+	}
+}
+
+// fieldKindOK reports whether a node holds a value of the given kind.
+func fieldKindOK(kind reflect.Kind, node *configNode) bool {
+	switch kind {
+	case reflect.Int:
+		_, isNum := node.scalar.(float64)
+		return isNum
+	case reflect.String:
+		_, isStr := node.scalar.(string)
+		return isStr
+	case reflect.Slice:
+		return node.items != nil && len(stringItems(node)) == len(node.items)
+	}
+	return true
+}
+
+func kindName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int:
+		return "a number"
+	case reflect.Slice:
+		return "an array of strings"
+	}
+	return "a string"
+}
+
+// stringItems returns the string items of an array node.
+func stringItems(node *configNode) []interface{} {
+	items := []interface{}{}
+	for _, item := range node.items {
+		if s, ok := item.scalar.(string); ok {
+			items = append(items, s)
+		}
+	}
+	return items
+}
+
+// cleanConfigFile rebuilds a config file from its node tree, leaving out the
+// unknown and mistyped values check reported. This lets strict mode go on to
+// validate the rest of the file. Entries that aren't objects are kept as
+// empty objects so that HSMs keep their positions.
+func cleanConfigFile(root *configNode) interface{} {
+	if root.items != nil {
+		return cleanConfigEntries(root.items)
+	}
+
+	top := map[string]interface{}{}
+
+	for key, node := range root.fields {
+		switch key {
+		case "defaults":
+			top[key] = cleanConfigEntry(node)
+		case "groups":
+			if node.fields != nil {
+				groups := map[string]interface{}{}
+				for name, group := range node.fields {
+					groups[name] = cleanConfigEntry(group)
+				}
+				top[key] = groups
+			}
+		case "hsms":
+			if node.items != nil {
+				top[key] = cleanConfigEntries(node.items)
+			}
+		case "include":
+			if node.items != nil {
+				top[key] = stringItems(node)
+			}
+		case "inventory":
+			if node.items != nil {
+				inventories := []interface{}{}
+				for _, item := range node.items {
+					inventories = append(inventories, cleanInventoryEntry(item))
+				}
+				top[key] = inventories
+			}
+		}
+	}
+
+	return top
+}
+
+func cleanConfigEntries(items []*configNode) []interface{} {
+	entries := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, cleanConfigEntry(item))
+	}
+	return entries
+}
+
+func cleanConfigEntry(node *configNode) map[string]interface{} {
+	entry := map[string]interface{}{}
+	known := configFields()
+
+	for key, value := range node.fields {
+		if kind, ok := known[key]; ok && fieldKindOK(kind, value) {
+			entry[key] = value.value()
+		}
+	}
+
+	return entry
+}
+
+func cleanInventoryEntry(node *configNode) map[string]interface{} {
+	entry := map[string]interface{}{}
+
+	for key, value := range node.fields {
+		switch key {
+		case "command", "ttl":
+			if _, isStr := value.scalar.(string); isStr {
+				entry[key] = value.scalar
+			}
+		case "args":
+			if value.items != nil {
+				entry[key] = stringItems(value)
+			}
+		}
+	}
+
+	return entry
+}
+
+// checkInventoryNode reports unknown or mistyped fields in an inventory.
+func (l *configLoader) checkInventoryNode(path string, node *configNode, what string) {
+	if node.fields == nil {
+		l.problem(path, node.line, "%s must be an object", what)
+		return
+	}
+
+	for _, key := range node.sortedKeys() {
+		value := node.fields[key]
+
+		switch key {
+		case "command", "ttl":
+			if _, isStr := value.scalar.(string); !isStr {
+				l.problem(path, value.line, "field '%s' in %s must be a string", key, what)
+			}
+		case "args":
+			if value.items == nil {
+				l.problem(path, value.line, "field '%s' in %s must be an array", key, what)
+			}
+		default:
+			l.problem(path, value.line, "unknown field '%s' in %s", key, what)
+		}
+	}
+}
+
+// validate reports problems with the fully resolved HSM configs.
+func (l *configLoader) validate(configs []*Config) {
+	names := map[string]int{}
+
+	for i, cfg := range configs {
+		file, line := l.location(i, "")
+		what := cfg.Name()
+
+		if src := l.sources[i]; cfg.Hostname == "" && src.inventory != "" {
+			what = fmt.Sprintf("hsm #%d from inventory '%s'", src.index+1, src.inventory)
+			l.problem(file, line, "%s is missing hostname", what)
+		} else if cfg.Hostname == "" {
+			what = fmt.Sprintf("hsm #%d", src.index+1)
+			l.problem(file, line, "%s is missing hostname", what)
+		}
+
+		if cfg.SSHport == 0 && !l.hasField(i, "ssh_port") {
+			l.problem(file, line, "%s is missing ssh_port", what)
+		} else if cfg.SSHport < 0 || cfg.SSHport > 65535 {
+			f, ln := l.location(i, "ssh_port")
+			l.problem(f, ln, "%s has invalid ssh_port %d", what, cfg.SSHport)
+		}
+
+		if cfg.SSHfingerprint == "" && !l.hasField(i, "ssh_fingerprint") {
+			l.problem(file, line, "%s is missing ssh_fingerprint", what)
+		} else if err := checkFingerprint(cfg.SSHfingerprint); err != nil {
+			f, ln := l.location(i, "ssh_fingerprint")
+			l.problem(f, ln, "%s has malformed ssh_fingerprint: %s", what, err)
+		}
+
+		if cfg.Transfer != "" && cfg.Transfer != TransferSCP && cfg.Transfer != TransferSFTP {
+			f, ln := l.location(i, "transfer")
+			l.problem(f, ln, "%s has invalid transfer '%s'. Must be %s or %s", what, cfg.Transfer, TransferSCP, TransferSFTP)
+		}
+
+		for _, name := range []string{cfg.Nickname, cfg.Hostname} {
+			if name == "" {
+				continue
+			}
+
+			if j, dup := names[name]; dup && j != i {
+				jfile, jline := l.location(j, "")
+				l.problem(file, line, "%s: name '%s' is also used by the HSM at %s",
+					what, name, formatLocation(jfile, jline))
+				continue
+			}
+			names[name] = i
+		}
+	}
+}
+
+// hasField reports whether the ith HSM's entry sets the field, even if it was
+// left out for having the wrong type.
+func (l *configLoader) hasField(i int, field string) bool {
+	node := l.entryNode(i)
+	if node == nil {
+		return false
+	}
+	_, ok := node.fields[field]
+	return ok
+}
+
+// location returns the file and line where the ith HSM, or one of its fields,
+// was defined.
+func (l *configLoader) location(i int, field string) (string, int) {
+	src := l.sources[i]
+
+	root := l.nodes[src.path]
+	if root == nil {
+		return src.path, 0
+	}
+
+	if src.inventory != "" {
+		if inv := root.fields["inventory"]; inv != nil {
+			return src.path, inv.line
+		}
+		return src.path, 0
+	}
+
+	node := l.entryNode(i)
+	if node == nil {
+		return src.path, 0
+	}
+
+	if f, ok := node.fields[field]; ok {
+		return src.path, f.line
+	}
+
+	return src.path, node.line
+}
+
+// entryNode returns the node the ith HSM was defined by, or nil for HSMs from
+// inventories.
+func (l *configLoader) entryNode(i int) *configNode {
+	src := l.sources[i]
+
+	root := l.nodes[src.path]
+	if root == nil || src.inventory != "" {
+		return nil
+	}
+
+	hsms := root
+	if root.fields != nil {
+		if hsms = root.fields["hsms"]; hsms == nil {
+			return nil
+		}
+	}
+
+	if src.index >= len(hsms.items) {
+		return nil
+	}
+
+	return hsms.items[src.index]
+}
+
+// checkFingerprint checks that fp looks like the output of
+// ssh.FingerprintSHA256.
+func checkFingerprint(fp string) error {
+	const prefix = "SHA256:"
+
+	if !strings.HasPrefix(fp, prefix) {
+		return fmt.Errorf("must start with '%s'", prefix)
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fp, prefix))
+	if err != nil {
+		return fmt.Errorf("bad base64")
+	}
+	if len(hash) != 32 {
+		return fmt.Errorf("expected 32 byte hash, got %d bytes", len(hash))
+	}
+
+	return nil
+}
+
+// configFields maps the names of Config fields to their kinds.
+func configFields() map[string]reflect.Kind {
+	fields := map[string]reflect.Kind{}
+
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i).Type.Kind()
+		}
+	}
+
+	return fields
+}
+
+// closestField suggests a known field name for a misspelled one.
+func closestField(key string) string {
+	best, bestDist := "", 3
+
+	for name := range configFields() {
+		if d := editDistance(key, name); d < bestDist || (d == bestDist && name < best) {
+			best, bestDist = name, d
+		}
+	}
+
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+// configNode is a parsed config file value along with the line it was
+// defined on.
+type configNode struct {
+	line   int
+	fields map[string]*configNode
+	items  []*configNode
+	scalar interface{}
+}
+
+// value converts a node back into the value it was parsed from.
+func (n *configNode) value() interface{} {
+	switch {
+	case n.fields != nil:
+		m := make(map[string]interface{}, len(n.fields))
+		for key, field := range n.fields {
+			m[key] = field.value()
+		}
+		return m
+	case n.items != nil:
+		items := make([]interface{}, 0, len(n.items))
+		for _, item := range n.items {
+			items = append(items, item.value())
+		}
+		return items
+	}
+	return n.scalar
+}
+
+func (n *configNode) sortedKeys() []string {
+	keys := make([]string, 0, len(n.fields))
+	for key := range n.fields {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return n.fields[keys[i]].line < n.fields[keys[j]].line ||
+			(n.fields[keys[i]].line == n.fields[keys[j]].line && keys[i] < keys[j])
+	})
+
+	return keys
+}
+
+// parseConfigNode parses a config file into a tree of configNodes.
+func parseConfigNode(data []byte, format string) (*configNode, error) {
+	switch format {
+	case FormatYAML:
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		if len(doc.Content) == 0 {
+			return &configNode{line: 1}, nil
+		}
+		return yamlConfigNode(doc.Content[0], doc.Content[0].Line), nil
+	case FormatTOML:
+		var v map[string]interface{}
+		if _, err := toml.Decode(string(data), &v); err != nil {
+			return nil, err
+		}
+		return tomlConfigNode(v, "", tomlLines(data), 1), nil
+	default:
+		p := &jsonNodeParser{dec: json.NewDecoder(bytes.NewReader(data)), data: data}
+		p.dec.UseNumber()
+		root, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.dec.Token(); err != io.EOF {
+			return nil, fmt.Errorf("unexpected data after top-level value")
+		}
+		return root, nil
+	}
+}
+
+func yamlConfigNode(n *yaml.Node, line int) *configNode {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+
+	node := &configNode{line: line}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		node.fields = map[string]*configNode{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			node.fields[key.Value] = yamlConfigNode(n.Content[i+1], key.Line)
+		}
+	case yaml.SequenceNode:
+		node.items = []*configNode{}
+		for _, item := range n.Content {
+			node.items = append(node.items, yamlConfigNode(item, item.Line))
+		}
+	case yaml.ScalarNode:
+		var v interface{}
+		if err := n.Decode(&v); err == nil {
+			node.scalar = normalizeScalar(v)
+		}
+	}
+
+	return node
+}
+
+func tomlConfigNode(v interface{}, path string, lines map[string]int, line int) *configNode {
+	node := &configNode{line: line}
+	if l, ok := lines[path]; ok {
+		node.line = l
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		node.fields = map[string]*configNode{}
+		for key, value := range v {
+			node.fields[key] = tomlConfigNode(value, joinPath(path, key), lines, node.line)
+		}
+	case []map[string]interface{}:
+		node.items = []*configNode{}
+		for i, value := range v {
+			node.items = append(node.items, tomlConfigNode(value, joinPath(path, strconv.Itoa(i)), lines, node.line))
+		}
+	case []interface{}:
+		node.items = []*configNode{}
+		for i, value := range v {
+			node.items = append(node.items, tomlConfigNode(value, joinPath(path, strconv.Itoa(i)), lines, node.line))
+		}
+	default:
+		node.scalar = normalizeScalar(v)
+	}
+
+	return node
+}
+
+var (
+	tomlTableRe = regexp.MustCompile(`^\[\s*([^\[\]]+?)\s*\]$`)
+	tomlArrayRe = regexp.MustCompile(`^\[\[\s*([^\[\]]+?)\s*\]\]$`)
+	tomlKeyRe   = regexp.MustCompile(`^([A-Za-z0-9_\-."]+?)\s*=`)
+)
+
+// tomlLines makes a best effort at finding the line each table and key in a
+// TOML document is defined on, since the TOML parser doesn't expose positions.
+func tomlLines(data []byte) map[string]int {
+	lines := map[string]int{}
+	counts := map[string]int{}
+	table := ""
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		if m := tomlArrayRe.FindStringSubmatch(line); m != nil {
+			name := tomlKey(m[1])
+			table = joinPath(name, strconv.Itoa(counts[name]))
+			counts[name]++
+			lines[table] = i + 1
+		} else if m := tomlTableRe.FindStringSubmatch(line); m != nil {
+			table = tomlKey(m[1])
+			lines[table] = i + 1
+		} else if m := tomlKeyRe.FindStringSubmatch(line); m != nil {
+			lines[joinPath(table, tomlKey(m[1]))] = i + 1
+		}
+	}
+
+	return lines
+}
+
+func tomlKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(parts[i]), `"`)
+	}
+	return strings.Join(parts, ".")
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// normalizeScalar converts numbers to float64, as encoding/json does.
+func normalizeScalar(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+// jsonNodeParser builds a configNode tree from a JSON document.
+type jsonNodeParser struct {
+	dec  *json.Decoder
+	data []byte
+}
+
+func (p *jsonNodeParser) parse() (*configNode, error) {
+	line := p.nextLine()
+
+	tok, err := p.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &configNode{line: line}
+
+	switch tok {
+	case json.Delim('{'):
+		node.fields = map[string]*configNode{}
+		for p.dec.More() {
+			keyLine := p.nextLine()
+			key, err := p.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			value.line = keyLine
+
+			node.fields[key.(string)] = value
+		}
+		_, err = p.dec.Token()
+	case json.Delim('['):
+		node.items = []*configNode{}
+		for p.dec.More() {
+			item, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+		}
+		_, err = p.dec.Token()
+	default:
+		node.scalar = normalizeScalar(tok)
+	}
+
+	return node, err
+}
+
+// nextLine returns the line that the decoder's next token starts on.
+func (p *jsonNodeParser) nextLine() int {
+	offset := int(p.dec.InputOffset())
+	for offset < len(p.data) && strings.IndexByte(" \t\r\n,:", p.data[offset]) >= 0 {
+		offset++
+	}
+	return lineAt(p.data, offset)
+}
+
+// lineAt returns the line number of the byte offset in data.
+func lineAt(data []byte, offset int) int {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+var yamlLineRe = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// syntaxErrorLine extracts the line number from a parser error.
+func syntaxErrorLine(data []byte, err error) (int, string) {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return lineAt(data, int(e.Offset)), e.Error()
+	case toml.ParseError:
+		return e.Position.Line, e.Message
+	}
+
+	if m := yamlLineRe.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return line, strings.TrimPrefix(err.Error(), m[0])
+	}
+
+	return 0, err.Error()
+}
@@ -0,0 +1,70 @@
+package lunash
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func problemStrings(err error) []string {
+	problems, ok := err.(ConfigErrors)
+	if !ok {
+		return nil
+	}
+
+	strs := make([]string, 0, len(problems))
+	for _, p := range problems {
+		strs = append(strs, p.String())
+	}
+	return strs
+}
+
+func TestLoadAllConfigsStrict(t *testing.T) {
+	for _, path := range []string{exampleConfigPath, "./example_lunash.yaml", "./testdata/lunash.toml"} {
+		strict, err := LoadAllConfigsStrict(path)
+		if assert.Nil(t, err, path) {
+			loose, _ := LoadAllConfigs(path)
+			assert.Equal(t, loose, strict)
+		}
+	}
+}
+
+func TestLoadAllConfigsStrictJSON(t *testing.T) {
+	_, err := LoadAllConfigsStrict("./testdata/invalid/lunash.json")
+	assert.Equal(t, []string{
+		"./testdata/invalid/lunash.json:4: unknown field 'ssh_prot' in hsm #1 (did you mean 'ssh_port'?)",
+		"./testdata/invalid/lunash.json:10: field 'ssh_port' in hsm #2 must be a number",
+		"./testdata/invalid/lunash.json:1: hsm1 is missing ssh_port",
+		"./testdata/invalid/lunash.json:12: hsm1 has malformed ssh_fingerprint: must start with 'SHA256:'",
+		"./testdata/invalid/lunash.json:7: hsm1: name 'hsm1' is also used by the HSM at ./testdata/invalid/lunash.json:1",
+	}, problemStrings(err))
+
+	_, err = LoadAllConfigsStrict("./testdata/invalid/syntax.json")
+	if assert.Equal(t, 1, len(problemStrings(err))) {
+		assert.Contains(t, problemStrings(err)[0], "./testdata/invalid/syntax.json:4: ")
+	}
+}
+
+func TestLoadAllConfigsStrictYAML(t *testing.T) {
+	_, err := LoadAllConfigsStrict("./testdata/invalid/lunash.yaml")
+	assert.Equal(t, []string{
+		"./testdata/invalid/lunash.yaml:11: hsm2 is in undefined group nope",
+		"./testdata/invalid/lunash.yaml:9: hsm2 is missing ssh_fingerprint",
+		"./testdata/invalid/lunash.yaml:9: hsm2: name '1.1.1.1' is also used by the HSM at ./testdata/invalid/lunash.yaml:5",
+	}, problemStrings(err))
+}
+
+func TestLoadAllConfigsStrictTOML(t *testing.T) {
+	_, err := LoadAllConfigsStrict("./testdata/invalid/lunash.toml")
+	assert.Equal(t, []string{
+		"./testdata/invalid/lunash.toml:11: unknown field 'hsm_pasword' in hsm #2 (did you mean 'hsm_password'?)",
+		"./testdata/invalid/lunash.toml:10: 2.2.2.2 has malformed ssh_fingerprint: expected 32 byte hash, got 6 bytes",
+	}, problemStrings(err))
+}
+
+func TestCheckFingerprint(t *testing.T) {
+	assert.Nil(t, checkFingerprint("SHA256:40QvIN7FAGgYxl+5UVoTskPK1zKswZcDzPCK6aZReuU"))
+	assert.NotNil(t, checkFingerprint("40QvIN7FAGgYxl+5UVoTskPK1zKswZcDzPCK6aZReuU"))
+	assert.NotNil(t, checkFingerprint("SHA256:40QvIN7FAGgYxl+5UVoTskPK1zKswZcDzPCK6aZ"))
+	assert.NotNil(t, checkFingerprint("SHA256:!!!"))
+}